@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// APIKeyScopeIngest allows sending logs to the project.
+	APIKeyScopeIngest = "ingest"
+	// APIKeyScopeRead allows querying the project's logs.
+	APIKeyScopeRead = "read"
+
+	// apiKeyPrefixLength is how much of a key is kept in plaintext so users
+	// can tell their keys apart.
+	apiKeyPrefixLength = 8
+	// maxAPIKeyLabelLength is the size of project_api_keys.label, in
+	// characters.
+	maxAPIKeyLabelLength = 255
+
+	defaultRotationGracePeriod = time.Hour
+	maxRotationGracePeriod     = 30 * 24 * time.Hour
+)
+
+// IngestionProject holds the settings of the project an API key belongs to,
+// together with what the key itself is allowed to do.
+type IngestionProject struct {
+	ID                   string
+	SearchableKeys       map[string]bool
+	SearchableKeysPolicy string
+	Scopes               map[string]bool
+	KeyExpiresAt         *time.Time
+	Limits               IngestionLimits
+	PayloadLimits        PayloadLimits
+}
+
+type APIKey struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	// APIKey is only set in the response that creates the key; the database
+	// keeps just its hash and prefix.
+	APIKey    string     `json:"api_key,omitempty"`
+	KeyPrefix string     `json:"key_prefix"`
+	Label     string     `json:"label"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+type CreateAPIKeyRequest struct {
+	Label            string   `json:"label"`
+	Scopes           []string `json:"scopes"`
+	ExpiresInSeconds int      `json:"expires_in_seconds"`
+}
+
+type UpdateAPIKeyRequest struct {
+	Label *string `json:"label"`
+}
+
+type RotateAPIKeyRequest struct {
+	GraceSeconds *int `json:"grace_seconds"`
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// hashAPIKey returns the hex SHA-256 of a key. Keys are 256 random bits, so
+// a fast unsalted hash is enough to keep them out of the database.
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func isValidAPIKeyScope(scope string) bool {
+	return scope == APIKeyScopeIngest || scope == APIKeyScopeRead
+}
+
+// validateAPIKey checks the X-API-KEY header against the project's active
+// keys and makes sure the key carries the required scope. It writes an error
+// response when the key is not valid. Valid keys are served from keyCache for
+// up to its TTL.
+func validateAPIKey(w http.ResponseWriter, projectID, apiKey, scope string) (*IngestionProject, bool) {
+	keyHash := hashAPIKey(apiKey)
+	project, ok := keyCache.Get(projectID, keyHash)
+	if !ok {
+		project = &IngestionProject{ID: projectID, SearchableKeys: make(map[string]bool), Scopes: make(map[string]bool)}
+		var searchableKeys, scopes []string
+		var expiresAt sql.NullTime
+		var maxBodyBytes int64
+		var maxPayloadBytes, maxSearchableKeys, maxSearchableValueLength int
+		var eventNamePattern string
+		err := db.QueryRow(`
+			SELECT p.searchable_keys, p.searchable_keys_policy, k.scopes, k.expires_at,
+			       p.rate_limit_per_second, p.rate_limit_burst, p.daily_log_quota,
+			       p.max_body_bytes, p.max_payload_bytes, p.max_searchable_keys, p.max_searchable_value_length, p.event_name_pattern
+			FROM project_api_keys k
+			JOIN projects p ON p.id = k.project_id
+			WHERE k.project_id = $1 AND k.key_hash = $2
+			  AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > now())
+		`, projectID, keyHash).Scan(pq.Array(&searchableKeys), &project.SearchableKeysPolicy, pq.Array(&scopes), &expiresAt,
+			&project.Limits.RatePerSecond, &project.Limits.Burst, &project.Limits.DailyQuota,
+			&maxBodyBytes, &maxPayloadBytes, &maxSearchableKeys, &maxSearchableValueLength, &eventNamePattern)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				RespondWithError(w, http.StatusUnauthorized, "Invalid API Key for this project")
+			} else {
+				slog.Error("API key validation failed", "project_id", projectID, "error", err)
+				RespondWithError(w, http.StatusInternalServerError, "Error validating API key")
+			}
+			return nil, false
+		}
+		for _, key := range searchableKeys {
+			project.SearchableKeys[key] = true
+		}
+		for _, s := range scopes {
+			project.Scopes[s] = true
+		}
+		if expiresAt.Valid {
+			project.KeyExpiresAt = &expiresAt.Time
+		}
+		project.PayloadLimits = newPayloadLimits(maxBodyBytes, maxPayloadBytes, maxSearchableKeys, maxSearchableValueLength, eventNamePattern)
+		keyCache.Add(projectID, keyHash, project)
+	}
+
+	if !project.Scopes[scope] {
+		RespondWithError(w, http.StatusForbidden, "API Key does not have the '"+scope+"' scope")
+		return nil, false
+	}
+	return project, true
+}
+
+// requireLogReadAccess authorizes a read of the project's logs either by an
+// X-API-KEY with the read scope or by a logged-in user whose role grants
+// permission.
+func requireLogReadAccess(w http.ResponseWriter, r *http.Request, projectID string, permission Permission) bool {
+	if apiKey := r.Header.Get("X-API-KEY"); apiKey != "" {
+		_, ok := validateAPIKey(w, projectID, apiKey, APIKeyScopeRead)
+		return ok
+	}
+	_, _, ok := authorizeProject(w, r, projectID, permission)
+	return ok
+}
+
+// insertAPIKey generates a new key for the project and stores its hash. The
+// returned APIKey is the only place the plaintext key is ever available.
+func insertAPIKey(q queryRower, projectID, label string, scopes []string, createdBy string, expiresAt *time.Time) (APIKey, error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key := APIKey{
+		ProjectID: projectID,
+		APIKey:    apiKey,
+		KeyPrefix: apiKey[:apiKeyPrefixLength],
+		Label:     label,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		Active:    true,
+	}
+	err = q.QueryRow(`
+		INSERT INTO project_api_keys (project_id, key_hash, key_prefix, label, scopes, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, projectID, hashAPIKey(apiKey), key.KeyPrefix, label, pq.Array(scopes), createdBy, expiresAt).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+	userID, _, ok := authorizeProject(w, r, projectID, PermissionManageKeys)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		listAPIKeysHandler(w, projectID)
+	case "POST":
+		createAPIKeyHandler(w, r, projectID, userID)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, projectID string) {
+	rows, err := db.Query(`
+		SELECT id, project_id, key_prefix, label, scopes, created_at, expires_at, revoked_at,
+		       revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		FROM project_api_keys
+		WHERE project_id = $1
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var expiresAt, revokedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.ProjectID, &k.KeyPrefix, &k.Label, pq.Array(&k.Scopes), &k.CreatedAt, &expiresAt, &revokedAt, &k.Active); err != nil {
+			slog.Error("Failed to scan API key", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to scan API key")
+			return
+		}
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		if revokedAt.Valid {
+			k.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, k)
+	}
+
+	RespondWithJSON(w, http.StatusOK, keys)
+}
+
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request, projectID, userID string) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if utf8.RuneCountInString(req.Label) > maxAPIKeyLabelLength {
+		RespondWithError(w, http.StatusBadRequest, "label must be at most 255 characters")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{APIKeyScopeIngest}
+	}
+	for _, scope := range req.Scopes {
+		if !isValidAPIKeyScope(scope) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid scope '"+scope+"': must be 'ingest' or 'read'")
+			return
+		}
+	}
+	if req.ExpiresInSeconds < 0 {
+		RespondWithError(w, http.StatusBadRequest, "expires_in_seconds must not be negative")
+		return
+	}
+	// Larger values would overflow the time.Duration below.
+	if int64(req.ExpiresInSeconds) > math.MaxInt64/int64(time.Second) {
+		RespondWithError(w, http.StatusBadRequest, "expires_in_seconds is too large")
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInSeconds > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expiresAt = &t
+	}
+
+	key, err := insertAPIKey(db, projectID, req.Label, req.Scopes, userID, expiresAt)
+	if err != nil {
+		requestLogger(r).Error("Failed to create API key", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusCreated, key)
+}
+
+func apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectId"]
+	keyID := vars["keyId"]
+	if _, _, ok := authorizeProject(w, r, projectID, PermissionManageKeys); !ok {
+		return
+	}
+	if !isValidUUID(keyID) {
+		RespondWithError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		updateAPIKeyHandler(w, r, projectID, keyID)
+	case "DELETE":
+		revokeAPIKeyHandler(w, projectID, keyID)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func updateAPIKeyHandler(w http.ResponseWriter, r *http.Request, projectID, keyID string) {
+	var req UpdateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Label == nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload: label is required")
+		return
+	}
+	if utf8.RuneCountInString(*req.Label) > maxAPIKeyLabelLength {
+		RespondWithError(w, http.StatusBadRequest, "label must be at most 255 characters")
+		return
+	}
+
+	res, err := db.Exec("UPDATE project_api_keys SET label = $1 WHERE id = $2 AND project_id = $3", *req.Label, keyID, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to update API key")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, projectID, keyID string) {
+	res, err := db.Exec("UPDATE project_api_keys SET revoked_at = now() WHERE id = $1 AND project_id = $2 AND revoked_at IS NULL", keyID, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "API key not found or already revoked")
+		return
+	}
+	keyCache.InvalidateProject(projectID)
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// rotateAPIKeyHandler replaces a key with a new one carrying the same label
+// and scopes. The old key keeps working for grace_seconds (default one hour)
+// so clients can switch over without dropping logs.
+func rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectId"]
+	keyID := vars["keyId"]
+	userID, _, ok := authorizeProject(w, r, projectID, PermissionManageKeys)
+	if !ok {
+		return
+	}
+	if !isValidUUID(keyID) {
+		RespondWithError(w, http.StatusNotFound, "API key not found or no longer active")
+		return
+	}
+
+	var req RotateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	grace := defaultRotationGracePeriod
+	if req.GraceSeconds != nil {
+		// Checked in seconds, so that a huge value cannot overflow the
+		// time.Duration and wrap into the allowed range.
+		if *req.GraceSeconds < 0 || int64(*req.GraceSeconds) > int64(maxRotationGracePeriod/time.Second) {
+			RespondWithError(w, http.StatusBadRequest, "grace_seconds must be between 0 and 2592000")
+			return
+		}
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var label string
+	var scopes []string
+	err = tx.QueryRow(`
+		SELECT label, scopes FROM project_api_keys
+		WHERE id = $1 AND project_id = $2
+		  AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+	`, keyID, projectID).Scan(&label, pq.Array(&scopes))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusNotFound, "API key not found or no longer active")
+		} else {
+			RespondWithError(w, http.StatusInternalServerError, "Database error")
+		}
+		return
+	}
+
+	newKey, err := insertAPIKey(tx, projectID, label, scopes, userID, nil)
+	if err != nil {
+		requestLogger(r).Error("Failed to create rotated API key", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	oldExpiresAt := time.Now().Add(grace)
+	_, err = tx.Exec(`
+		UPDATE project_api_keys SET expires_at = $1
+		WHERE id = $2 AND (expires_at IS NULL OR expires_at > $1)
+	`, oldExpiresAt, keyID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to expire the old API key")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	keyCache.InvalidateProject(projectID)
+
+	RespondWithJSON(w, http.StatusCreated, map[string]interface{}{
+		"api_key":            newKey,
+		"previous_key_id":    keyID,
+		"previous_key_until": oldExpiresAt,
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Project roles, stored in user_project_access.role.
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+)
+
+// Permission is an action on a project that a role may or may not allow.
+type Permission string
+
+const (
+	PermissionViewProject    Permission = "view_project"
+	PermissionReadAggregates Permission = "read_aggregates"
+	PermissionReadLogs       Permission = "read_logs"
+	PermissionManageKeys     Permission = "manage_keys"
+	PermissionManageMembers  Permission = "manage_members"
+	PermissionManageProject  Permission = "manage_project"
+)
+
+// rolePermissions lists what each role may do. Viewers see aggregates only,
+// members can also read individual logs, and admins can also edit the project
+// and manage its API keys and members.
+var rolePermissions = map[string]map[Permission]bool{
+	RoleViewer: {
+		PermissionViewProject:    true,
+		PermissionReadAggregates: true,
+	},
+	RoleMember: {
+		PermissionViewProject:    true,
+		PermissionReadAggregates: true,
+		PermissionReadLogs:       true,
+	},
+	RoleAdmin: {
+		PermissionViewProject:    true,
+		PermissionReadAggregates: true,
+		PermissionReadLogs:       true,
+		PermissionManageKeys:     true,
+		PermissionManageMembers:  true,
+		PermissionManageProject:  true,
+	},
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// isValidUUID reports whether id is a UUID in its canonical textual form,
+// as CockroachDB returns user, project, key and job IDs. Checking IDs taken
+// from the request first turns a malformed one into a 404 or 400 instead of
+// a failed query.
+func isValidUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// roleAllows reports whether role grants permission. Unknown roles grant
+// nothing.
+func roleAllows(role string, permission Permission) bool {
+	return rolePermissions[role][permission]
+}
+
+// sessionUserID returns the ID of the logged-in user, if any.
+func sessionUserID(r *http.Request) (string, bool) {
+	session, _ := store.Get(r, "logsys-session")
+	userID, ok := session.Values["user_id"].(string)
+	return userID, ok
+}
+
+// authorizeProject checks that the session user is a member of the project
+// whose role grants permission, and writes a 401, 403 or 404 response when
+// not. Projects being deleted are reported as not found. It returns the
+// user's ID and role.
+func authorizeProject(w http.ResponseWriter, r *http.Request, projectID string, permission Permission) (userID, role string, ok bool) {
+	userID, ok = sessionUserID(r)
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return "", "", false
+	}
+
+	var active bool
+	err := db.QueryRow(`
+		SELECT upa.role, p.is_active IS NOT FALSE
+		FROM user_project_access upa
+		JOIN projects p ON p.id = upa.project_id
+		WHERE upa.user_id = $1 AND upa.project_id = $2
+	`, userID, projectID).Scan(&role, &active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusForbidden, "You do not have access to this project")
+		} else {
+			requestLogger(r).Error("Failed to check project access", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Database error on access check")
+		}
+		return "", "", false
+	}
+	if !active {
+		RespondWithError(w, http.StatusNotFound, "Project not found")
+		return "", "", false
+	}
+	if !roleAllows(role, permission) {
+		RespondWithError(w, http.StatusForbidden, "Your role '"+role+"' does not allow "+string(permission)+" on this project")
+		return "", "", false
+	}
+	return userID, role, true
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestIsValidUUID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", true},
+		{"6BA7B810-9DAD-11D1-80B4-00C04FD430C8", true},
+		{"", false},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430c", false},
+		{"6ba7b8109dad11d180b400c04fd430c8", false},
+		{"6ba7b810-9dad-11d1-80b4-00c04fd430cg", false},
+		{"6ba7b810_9dad_11d1_80b4_00c04fd430c8", false},
+		{"' OR 1=1 --", false},
+	}
+	for _, tt := range tests {
+		if got := isValidUUID(tt.id); got != tt.want {
+			t.Errorf("isValidUUID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/kafka-go"
+)
+
+// maxBatchSize is the largest number of log entries accepted in one batch request.
+const maxBatchSize = 5000
+
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	LogID  string `json:"log_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchIngestionResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// logBatchIngestionHandler accepts a JSON array or an NDJSON stream of log
+// entries, validates each of them and produces all valid ones to Kafka with
+// a single writer call.
+func logBatchIngestionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectId"]
+	apiKey := r.Header.Get("X-API-KEY")
+
+	project, ok := validateAPIKey(w, projectID, apiKey, APIKeyScopeIngest)
+	if !ok {
+		return
+	}
+	if err := openBody(w, r, project); err != nil {
+		respondWithBodyError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	entries, err := readBatchEntries(r.Body)
+	if err != nil {
+		respondWithBodyError(w, err)
+		return
+	}
+	if len(entries) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "Batch contains no log entries")
+		return
+	}
+	if len(entries) > maxBatchSize {
+		RespondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Batch exceeds the maximum of %d log entries", maxBatchSize))
+		return
+	}
+
+	resp := BatchIngestionResponse{Results: make([]BatchItemResult, len(entries))}
+	msgs := make([]kafka.Message, 0, len(entries))
+	msgIndexes := make([]int, 0, len(entries))
+	schemaChecks := make([]*schemaCheck, 0, len(entries))
+	// Rejections that are not the client's fault decide the status when
+	// nothing was accepted.
+	var internalFailures, produceFailures int
+	for i, raw := range entries {
+		resp.Results[i] = BatchItemResult{Index: i, Status: "rejected"}
+
+		var logPayload LogIngestionPayload
+		if err := json.Unmarshal(raw, &logPayload); err != nil {
+			resp.Results[i].Error = "Invalid log entry: " + err.Error()
+			continue
+		}
+		if err := validateLogPayload(r.Context(), &logPayload, project); err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+
+		logID, err := assignLogID(projectID, &logPayload)
+		if err != nil {
+			requestLogger(r).Error("Failed to assign log ID", "project_id", projectID, "error", err)
+			resp.Results[i].Error = "Failed to process log"
+			internalFailures++
+			continue
+		}
+		msg, err := buildKafkaMessage(projectID, logID, requestID(r), &logPayload)
+		if err != nil {
+			if validationErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				resp.Results[i].Error = err.Error()
+				continue
+			}
+			requestLogger(r).Error("Failed to build Kafka message", "project_id", projectID, "error", err)
+			resp.Results[i].Error = "Failed to process log"
+			internalFailures++
+			continue
+		}
+		resp.Results[i].LogID = logID.String()
+		msgs = append(msgs, msg)
+		msgIndexes = append(msgIndexes, i)
+		schemaChecks = append(schemaChecks, logPayload.schemaCheck)
+	}
+
+	if len(msgs) > 0 {
+		// The batch is limited as a whole: either all its valid entries fit
+		// in the project's limits or none of them is accepted.
+		grant, ok := enforceIngestionLimits(w, r, project, len(msgs))
+		if !ok {
+			return
+		}
+		if err := nextKafkaWriter().WriteMessages(r.Context(), msgs...); err != nil {
+			requestLogger(r).Error("Failed to write batch to Kafka", "project_id", projectID, "messages", len(msgs), "error", err)
+			writeErrs, partial := err.(kafka.WriteErrors)
+			for j, i := range msgIndexes {
+				if !partial || writeErrs[j] != nil {
+					kafkaProduceErrors.Inc()
+					resp.Results[i].LogID = ""
+					resp.Results[i].Error = "Failed to process log"
+					produceFailures++
+					continue
+				}
+				resp.Results[i].Status = "accepted"
+				schemaStats.Record(schemaChecks[j])
+			}
+			grant.Release(produceFailures)
+		} else {
+			for j, i := range msgIndexes {
+				resp.Results[i].Status = "accepted"
+				schemaStats.Record(schemaChecks[j])
+			}
+		}
+	}
+
+	for _, res := range resp.Results {
+		if res.Status == "accepted" {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	if resp.Accepted > 0 {
+		logsAccepted.WithLabelValues(projectLabels.Label(projectID)).Add(float64(resp.Accepted))
+		usageCounter.Record(projectID, resp.Accepted)
+	}
+
+	status := http.StatusAccepted
+	if resp.Accepted == 0 {
+		switch {
+		case produceFailures > 0:
+			status = http.StatusServiceUnavailable
+		case internalFailures > 0:
+			status = http.StatusInternalServerError
+		default:
+			status = http.StatusBadRequest
+		}
+	}
+	RespondWithJSON(w, status, resp)
+}
+
+// readBatchEntries splits the request body into raw log entries. A body whose
+// first non-whitespace character is '[' is decoded as a JSON array, anything
+// else is treated as newline-delimited JSON.
+func readBatchEntries(body io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(body)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		br.UnreadByte()
+		if b == '[' {
+			var entries []json.RawMessage
+			if err := json.NewDecoder(br).Decode(&entries); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		}
+		break
+	}
+
+	var entries []json.RawMessage
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entries = append(entries, json.RawMessage(append([]byte(nil), line...)))
+		if len(entries) > maxBatchSize {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
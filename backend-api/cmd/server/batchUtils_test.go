@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadBatchEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "JSON array",
+			body: `[{"name":"a"},{"name":"b"}]`,
+			want: []string{`{"name":"a"}`, `{"name":"b"}`},
+		},
+		{
+			name: "JSON array after whitespace",
+			body: " \r\n\t[{\"name\":\"a\"}]",
+			want: []string{`{"name":"a"}`},
+		},
+		{
+			name: "NDJSON",
+			body: "{\"name\":\"a\"}\n{\"name\":\"b\"}\n",
+			want: []string{`{"name":"a"}`, `{"name":"b"}`},
+		},
+		{
+			name: "NDJSON with blank lines and CRLF",
+			body: "\n{\"name\":\"a\"}\r\n\n  \n{\"name\":\"b\"}",
+			want: []string{`{"name":"a"}`, `{"name":"b"}`},
+		},
+		{
+			name: "NDJSON keeps invalid lines for per-entry errors",
+			body: "{\"name\":\"a\"}\nnot json\n",
+			want: []string{`{"name":"a"}`, `not json`},
+		},
+		{
+			name: "empty body",
+			body: "",
+			want: nil,
+		},
+		{
+			name: "whitespace only",
+			body: " \n\t\n",
+			want: nil,
+		},
+		{
+			name: "empty array",
+			body: "[]",
+			want: []string{},
+		},
+		{
+			name:    "truncated array",
+			body:    `[{"name":"a"},`,
+			wantErr: true,
+		},
+		{
+			name: "array of non-objects is still split",
+			body: `[1, "two"]`,
+			want: []string{`1`, `"two"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := readBatchEntries(strings.NewReader(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readBatchEntries() = %q, want an error", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBatchEntries() error = %v", err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("readBatchEntries() returned %d entries, want %d: %q", len(entries), len(tt.want), entries)
+			}
+			for i, entry := range entries {
+				if string(entry) != tt.want[i] {
+					t.Errorf("entry %d = %s, want %s", i, entry, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadBatchEntriesStopsPastMaxBatchSize(t *testing.T) {
+	body := strings.Repeat("{\"name\":\"a\"}\n", maxBatchSize+100)
+	entries, err := readBatchEntries(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("readBatchEntries() error = %v", err)
+	}
+	// One entry over the maximum is enough for the handler to refuse the
+	// batch; the rest is not read.
+	if len(entries) != maxBatchSize+1 {
+		t.Errorf("readBatchEntries() returned %d entries, want %d", len(entries), maxBatchSize+1)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAPIKeyCacheSize = 10000
+	defaultAPIKeyCacheTTL  = 30 * time.Second
+)
+
+// apiKeyCache is a bounded LRU cache of validated (project, API key) pairs.
+// Entries expire after a fixed TTL, so a rotated or revoked key stops being
+// accepted at most one TTL after the change even on replicas that did not
+// see it happen.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type apiKeyCacheEntry struct {
+	key       string
+	project   *IngestionProject
+	expiresAt time.Time
+}
+
+// APIKeyCacheStats is a snapshot of the cache, exported as metrics.
+type APIKeyCacheStats struct {
+	Size       int
+	Capacity   int
+	TTLSeconds float64
+	Hits       uint64
+	Misses     uint64
+}
+
+func newAPIKeyCache(size int, ttl time.Duration) *apiKeyCache {
+	return &apiKeyCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// newAPIKeyCacheFromEnv builds the cache from API_KEY_CACHE_SIZE and
+// API_KEY_CACHE_TTL_SECONDS. A size or TTL of 0 disables caching.
+func newAPIKeyCacheFromEnv() *apiKeyCache {
+	size := defaultAPIKeyCacheSize
+	if v, err := strconv.Atoi(os.Getenv("API_KEY_CACHE_SIZE")); err == nil && v >= 0 {
+		size = v
+	}
+	ttl := defaultAPIKeyCacheTTL
+	if v, err := strconv.Atoi(os.Getenv("API_KEY_CACHE_TTL_SECONDS")); err == nil && v >= 0 {
+		ttl = time.Duration(v) * time.Second
+	}
+	return newAPIKeyCache(size, ttl)
+}
+
+func apiKeyCacheKey(projectID, apiKey string) string {
+	return projectID + "\x00" + apiKey
+}
+
+// Get returns the cached project for a (project, key) pair that was
+// validated less than one TTL ago.
+func (c *apiKeyCache) Get(projectID, apiKey string) (*IngestionProject, bool) {
+	key := apiKeyCacheKey(projectID, apiKey)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := elem.Value.(*apiKeyCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits.Add(1)
+	return entry.project, true
+}
+
+// Add records a valid (project, key) pair, evicting the least recently used
+// entry when the cache is full. An entry never outlives the key's own expiry.
+func (c *apiKeyCache) Add(projectID, apiKey string, project *IngestionProject) {
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+	key := apiKeyCacheKey(projectID, apiKey)
+	expiresAt := time.Now().Add(c.ttl)
+	if project.KeyExpiresAt != nil && project.KeyExpiresAt.Before(expiresAt) {
+		expiresAt = *project.KeyExpiresAt
+	}
+	entry := &apiKeyCacheEntry{key: key, project: project, expiresAt: expiresAt}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// InvalidateProject drops every cached key of a project.
+func (c *apiKeyCache) InvalidateProject(projectID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries {
+		if elem.Value.(*apiKeyCacheEntry).project.ID == projectID {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *apiKeyCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*apiKeyCacheEntry).key)
+}
+
+func (c *apiKeyCache) Stats() APIKeyCacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+	return APIKeyCacheStats{
+		Size:       size,
+		Capacity:   c.size,
+		TTLSeconds: c.ttl.Seconds(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+	}
+}
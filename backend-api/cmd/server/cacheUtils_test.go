@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyCache(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	type op struct {
+		add        bool // Add the pair if true, Get it otherwise
+		invalidate string
+		projectID  string
+		apiKey     string
+		expiresAt  *time.Time
+		wantHit    bool
+	}
+	tests := []struct {
+		name string
+		size int
+		ttl  time.Duration
+		ops  []op
+	}{
+		{
+			name: "miss then hit",
+			size: 2, ttl: time.Minute,
+			ops: []op{
+				{projectID: "p1", apiKey: "k1"},
+				{add: true, projectID: "p1", apiKey: "k1"},
+				{projectID: "p1", apiKey: "k1", wantHit: true},
+				{projectID: "p2", apiKey: "k1"},
+				{projectID: "p1", apiKey: "k2"},
+			},
+		},
+		{
+			name: "least recently used is evicted",
+			size: 2, ttl: time.Minute,
+			ops: []op{
+				{add: true, projectID: "p1", apiKey: "k1"},
+				{add: true, projectID: "p1", apiKey: "k2"},
+				{projectID: "p1", apiKey: "k1", wantHit: true},
+				{add: true, projectID: "p1", apiKey: "k3"},
+				{projectID: "p1", apiKey: "k2"},
+				{projectID: "p1", apiKey: "k1", wantHit: true},
+				{projectID: "p1", apiKey: "k3", wantHit: true},
+			},
+		},
+		{
+			name: "entry does not outlive the key",
+			size: 2, ttl: time.Minute,
+			ops: []op{
+				{add: true, projectID: "p1", apiKey: "expired", expiresAt: &past},
+				{projectID: "p1", apiKey: "expired"},
+				{add: true, projectID: "p1", apiKey: "valid", expiresAt: &future},
+				{projectID: "p1", apiKey: "valid", wantHit: true},
+			},
+		},
+		{
+			name: "invalidating a project drops only its keys",
+			size: 4, ttl: time.Minute,
+			ops: []op{
+				{add: true, projectID: "p1", apiKey: "k1"},
+				{add: true, projectID: "p1", apiKey: "k2"},
+				{add: true, projectID: "p2", apiKey: "k1"},
+				{invalidate: "p1"},
+				{projectID: "p1", apiKey: "k1"},
+				{projectID: "p1", apiKey: "k2"},
+				{projectID: "p2", apiKey: "k1", wantHit: true},
+			},
+		},
+		{
+			name: "size 0 disables caching",
+			size: 0, ttl: time.Minute,
+			ops: []op{
+				{add: true, projectID: "p1", apiKey: "k1"},
+				{projectID: "p1", apiKey: "k1"},
+			},
+		},
+		{
+			name: "TTL 0 disables caching",
+			size: 2, ttl: 0,
+			ops: []op{
+				{add: true, projectID: "p1", apiKey: "k1"},
+				{projectID: "p1", apiKey: "k1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newAPIKeyCache(tt.size, tt.ttl)
+			var wantHits, wantMisses uint64
+			for i, o := range tt.ops {
+				switch {
+				case o.invalidate != "":
+					c.InvalidateProject(o.invalidate)
+				case o.add:
+					c.Add(o.projectID, o.apiKey, &IngestionProject{ID: o.projectID, KeyExpiresAt: o.expiresAt})
+				default:
+					project, hit := c.Get(o.projectID, o.apiKey)
+					if hit != o.wantHit {
+						t.Fatalf("op %d: Get(%s, %s) hit = %v, want %v", i, o.projectID, o.apiKey, hit, o.wantHit)
+					}
+					if hit {
+						wantHits++
+						if project.ID != o.projectID {
+							t.Errorf("op %d: Get(%s, %s) returned project %s", i, o.projectID, o.apiKey, project.ID)
+						}
+					} else {
+						wantMisses++
+					}
+				}
+			}
+			stats := c.Stats()
+			if stats.Hits != wantHits || stats.Misses != wantMisses {
+				t.Errorf("Stats() hits = %d, misses = %d, want %d and %d", stats.Hits, stats.Misses, wantHits, wantMisses)
+			}
+			if stats.Size > max(tt.size, 0) {
+				t.Errorf("Stats() size = %d, over the capacity of %d", stats.Size, tt.size)
+			}
+		})
+	}
+}
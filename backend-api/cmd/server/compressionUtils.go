@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/segmentio/kafka-go"
+)
+
+// acceptedContentEncodings is sent back with a 415 for an encoding that
+// ingestion does not decode.
+const acceptedContentEncodings = "gzip, zstd"
+
+// UnsupportedEncodingError is returned for a request body in a
+// Content-Encoding that ingestion does not decode.
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("Unsupported Content-Encoding '%s'; use one of: %s", e.Encoding, acceptedContentEncodings)
+}
+
+// openBody caps the bytes a handler can read from the request body and
+// decodes it according to its Content-Encoding. The project's body limit
+// applies to both the bytes on the wire and the decoded bytes, so a small
+// compressed body cannot expand past it.
+func openBody(w http.ResponseWriter, r *http.Request, project *IngestionProject) error {
+	limit := project.PayloadLimits.MaxBodyBytes
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	var decoded io.ReadCloser
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+		decoded = zr
+	case "zstd":
+		zr, err := getZstdDecoder(r.Body, limit)
+		if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		decoded = zr
+	default:
+		return &UnsupportedEncodingError{Encoding: encoding}
+	}
+	r.Body = http.MaxBytesReader(w, &decodedBody{ReadCloser: decoded, raw: r.Body}, limit)
+	return nil
+}
+
+// decodedBody closes both the decoder and the body it reads from.
+type decodedBody struct {
+	io.ReadCloser
+	raw io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
+
+// zstdDecoderPools holds a *sync.Pool of zstd decoders per body limit, since
+// a decoder's window and memory limits are fixed when it is created. Projects
+// share a handful of limits, so there are only a few pools.
+var zstdDecoderPools sync.Map
+
+// getZstdDecoder returns a pooled decoder reading from r. The decoder refuses
+// frames that declare a window larger than limit, so a tiny frame cannot make
+// it allocate more memory than the body it may produce. Closing the returned
+// reader puts the decoder back into its pool.
+func getZstdDecoder(r io.Reader, limit int64) (io.ReadCloser, error) {
+	window := max(limit, zstd.MinWindowSize)
+	pool, _ := zstdDecoderPools.LoadOrStore(window, &sync.Pool{})
+	dec, _ := pool.(*sync.Pool).Get().(*zstd.Decoder)
+	if dec == nil {
+		var err error
+		dec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(uint64(window)), zstd.WithDecoderMaxMemory(uint64(window)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := dec.Reset(r); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return &pooledZstdDecoder{dec: dec, pool: pool.(*sync.Pool)}, nil
+}
+
+type pooledZstdDecoder struct {
+	dec  *zstd.Decoder
+	pool *sync.Pool
+}
+
+func (d *pooledZstdDecoder) Read(p []byte) (int, error) {
+	if d.dec == nil {
+		return 0, errors.New("zstd: read after close")
+	}
+	return d.dec.Read(p)
+}
+
+// Close returns the decoder to its pool. It is safe to call more than once.
+func (d *pooledZstdDecoder) Close() error {
+	if d.dec == nil {
+		return nil
+	}
+	// Dropping the reader lets the request body be collected while the
+	// decoder waits in the pool.
+	d.dec.Reset(nil)
+	d.pool.Put(d.dec)
+	d.dec = nil
+	return nil
+}
+
+// respondWithBodyError answers an error from openBody or from reading the
+// body it opened.
+func respondWithBodyError(w http.ResponseWriter, err error) {
+	var encodingErr *UnsupportedEncodingError
+	if errors.As(err, &encodingErr) {
+		w.Header().Set("Accept-Encoding", acceptedContentEncodings)
+		RespondWithError(w, http.StatusUnsupportedMediaType, encodingErr.Error())
+		return
+	}
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		RespondWithError(w, http.StatusRequestEntityTooLarge, "Decoded request body exceeds the project's body limit")
+		return
+	}
+	status, message := bodyReadError(err)
+	RespondWithError(w, status, message)
+}
+
+// kafkaCompressionFromEnv reads KAFKA_COMPRESSION, the codec the Kafka
+// writers compress message batches with: none (the default), gzip, snappy,
+// lz4 or zstd.
+func kafkaCompressionFromEnv() (kafka.Compression, error) {
+	var compression kafka.Compression
+	if v := os.Getenv("KAFKA_COMPRESSION"); v != "" {
+		if err := compression.UnmarshalText([]byte(strings.ToLower(v))); err != nil {
+			return 0, err
+		}
+	}
+	return compression, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// healthCheckTimeout bounds each dependency check of a readiness probe.
+const healthCheckTimeout = 2 * time.Second
+
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// liveHandler reports that the process is running. It checks no dependency,
+// so an outage elsewhere never gets the container restarted.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// readyHandler checks every dependency the API needs to serve requests and
+// answers 503 if any of them is down.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := []dependencyCheck{
+		{"cockroachdb", func(ctx context.Context) error { return db.PingContext(ctx) }},
+		{"clickhouse", func(ctx context.Context) error { return chConn.Ping(ctx) }},
+		{"cassandra", func(ctx context.Context) error {
+			return cassandra.Query(`SELECT release_version FROM system.local`).WithContext(ctx).Exec()
+		}},
+	}
+	for _, writer := range kafkaWriters {
+		broker := writer.Addr.String()
+		checks = append(checks, dependencyCheck{"kafka:" + broker, func(ctx context.Context) error {
+			return pingKafkaBroker(ctx, broker)
+		}})
+	}
+
+	resp := runDependencyChecks(r.Context(), checks)
+	status := http.StatusOK
+	if resp.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	RespondWithJSON(w, status, resp)
+}
+
+// runDependencyChecks runs the checks concurrently, each with its own timeout.
+func runDependencyChecks(ctx context.Context, checks []dependencyCheck) ReadinessResponse {
+	resp := ReadinessResponse{Status: "ready", Dependencies: make([]DependencyStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c dependencyCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(checkCtx)
+			dep := DependencyStatus{
+				Name:      c.name,
+				Status:    "up",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				dep.Status = "down"
+				dep.Error = err.Error()
+			}
+			resp.Dependencies[i] = dep
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, dep := range resp.Dependencies {
+		if dep.Status != "up" {
+			resp.Status = "not ready"
+		}
+	}
+	return resp
+}
+
+// pingKafkaBroker connects to a broker and asks it for the cluster's brokers.
+func pingKafkaBroker(ctx context.Context, broker string) error {
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Brokers(); err != nil {
+		return fmt.Errorf("list brokers: %w", err)
+	}
+	return nil
+}
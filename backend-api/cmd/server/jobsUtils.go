@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// JobKindDeleteProject purges a project's logs and then deletes it.
+	JobKindDeleteProject = "delete_project"
+
+	// jobPollInterval is how often each replica looks for jobs that are due,
+	// including ones abandoned by a replica that died.
+	jobPollInterval = 10 * time.Second
+	// jobLease is how long a claimed job belongs to a replica. The lease is
+	// renewed every jobLease/4 while the job runs.
+	jobLease = 5 * time.Minute
+	// maxJobAttempts is how many times a failing job is tried before it is
+	// marked failed. Attempts are spaced by a growing delay.
+	maxJobAttempts = 5
+	// defaultPurgeDelay is how long a deleted project's data is left alone
+	// before it is purged unless PROJECT_PURGE_DELAY_SECONDS says otherwise.
+	// It has to outlast the processor's project settings cache, so that logs
+	// already in Kafka are dropped instead of written after the purge.
+	defaultPurgeDelay = 2 * time.Minute
+	// purgeLookupWorkers bounds the concurrent deletes of lookup rows.
+	purgeLookupWorkers = 16
+)
+
+// ProjectJob is a row of project_jobs. Status moves from pending to running
+// and ends as succeeded or failed; a failed attempt goes back to pending until
+// the job runs out of attempts.
+type ProjectJob struct {
+	ID         string     `json:"id"`
+	ProjectID  string     `json:"project_id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Step       string     `json:"step,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Attempts   int        `json:"attempts"`
+	RunAfter   time.Time  `json:"run_after"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobRunner runs the jobs in project_jobs. Every replica runs one; a job is
+// claimed with a lease, so it runs on one replica at a time and is picked up
+// again if that replica dies. Job steps must be safe to repeat.
+type jobRunner struct {
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+var jobs = &jobRunner{wake: make(chan struct{}, 1)}
+
+// purgeDelayFromEnv reads PROJECT_PURGE_DELAY_SECONDS.
+func purgeDelayFromEnv() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("PROJECT_PURGE_DELAY_SECONDS")); err == nil && v >= 0 {
+		return time.Duration(v) * time.Second
+	}
+	return defaultPurgeDelay
+}
+
+// Start runs jobs until ctx is cancelled.
+func (j *jobRunner) Start(ctx context.Context) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(jobPollInterval)
+		defer ticker.Stop()
+		for {
+			for j.runNext(ctx) {
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-j.wake:
+			}
+		}
+	}()
+}
+
+// Wait blocks until the runner has stopped.
+func (j *jobRunner) Wait() {
+	j.wg.Wait()
+}
+
+// Notify makes the runner look for due jobs now.
+func (j *jobRunner) Notify() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runNext claims and runs one due job. It reports whether there was one.
+func (j *jobRunner) runNext(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var job ProjectJob
+	err := db.QueryRowContext(ctx, `
+		UPDATE project_jobs
+		SET status = 'running', attempts = attempts + 1, lease_until = now() + $1 * INTERVAL '1 second',
+		    started_at = COALESCE(started_at, now()), updated_at = now()
+		WHERE id = (
+			SELECT id FROM project_jobs
+			WHERE (status = 'pending' AND run_after <= now()) OR (status = 'running' AND lease_until < now())
+			ORDER BY run_after
+			LIMIT 1
+		) AND ((status = 'pending' AND run_after <= now()) OR (status = 'running' AND lease_until < now()))
+		RETURNING id, project_id, kind, attempts
+	`, int(jobLease.Seconds())).Scan(&job.ID, &job.ProjectID, &job.Kind, &job.Attempts)
+	if err != nil {
+		if err != sql.ErrNoRows && ctx.Err() == nil {
+			slog.Error("Failed to claim job", "error", err)
+		}
+		return false
+	}
+
+	logger := slog.Default().With("job_id", job.ID, "project_id", job.ProjectID, "kind", job.Kind, "attempt", job.Attempts)
+	logger.Info("Running job")
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go j.renewLease(jobCtx, job.ID)
+
+	switch job.Kind {
+	case JobKindDeleteProject:
+		err = runDeleteProjectJob(jobCtx, job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the lease runs out and another replica takes over.
+		return false
+	}
+	j.finish(job, err, logger)
+	return true
+}
+
+// renewLease extends the job's lease until ctx is cancelled.
+func (j *jobRunner) renewLease(ctx context.Context, jobID string) {
+	ticker := time.NewTicker(jobLease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := db.ExecContext(ctx, `UPDATE project_jobs SET lease_until = now() + $1 * INTERVAL '1 second' WHERE id = $2 AND status = 'running'`,
+				int(jobLease.Seconds()), jobID)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to renew job lease", "job_id", jobID, "error", err)
+			}
+		}
+	}
+}
+
+// finish records the outcome of a run. A failed run is retried later until
+// maxJobAttempts is reached.
+func (j *jobRunner) finish(job ProjectJob, runErr error, logger *slog.Logger) {
+	var err error
+	switch {
+	case runErr == nil:
+		logger.Info("Job succeeded")
+		_, err = db.Exec(`
+			UPDATE project_jobs SET status = 'succeeded', step = 'done', error = NULL, lease_until = NULL,
+			       finished_at = now(), updated_at = now()
+			WHERE id = $1`, job.ID)
+	case job.Attempts >= maxJobAttempts:
+		logger.Error("Job failed, giving up", "error", runErr)
+		_, err = db.Exec(`
+			UPDATE project_jobs SET status = 'failed', error = $1, lease_until = NULL, finished_at = now(), updated_at = now()
+			WHERE id = $2`, runErr.Error(), job.ID)
+	default:
+		delay := time.Duration(job.Attempts*job.Attempts) * time.Minute
+		logger.Warn("Job failed, will retry", "retry_in", delay, "error", runErr)
+		_, err = db.Exec(`
+			UPDATE project_jobs SET status = 'pending', error = $1, lease_until = NULL,
+			       run_after = now() + $2 * INTERVAL '1 second', updated_at = now()
+			WHERE id = $3`, runErr.Error(), int(delay.Seconds()), job.ID)
+	}
+	if err != nil {
+		logger.Error("Failed to record job outcome", "error", err)
+	}
+}
+
+// setJobStep records which step of a job is running, for whoever polls it.
+func setJobStep(ctx context.Context, jobID, step string) error {
+	_, err := db.ExecContext(ctx, `UPDATE project_jobs SET step = $1, updated_at = now() WHERE id = $2`, step, jobID)
+	return err
+}
+
+// runDeleteProjectJob purges a deactivated project's logs from Cassandra and
+// ClickHouse, then deletes the project, which also removes its members and
+// API keys.
+func runDeleteProjectJob(ctx context.Context, job ProjectJob) error {
+	if err := setJobStep(ctx, job.ID, "purging_cassandra"); err != nil {
+		return err
+	}
+	if err := purgeCassandraLogs(ctx, job.ProjectID); err != nil {
+		return err
+	}
+
+	if err := setJobStep(ctx, job.ID, "purging_clickhouse"); err != nil {
+		return err
+	}
+	if err := deleteClickHouseLogs(ctx, chConn, "project_id = ?", job.ProjectID); err != nil {
+		return fmt.Errorf("delete ClickHouse logs: %w", err)
+	}
+
+	if err := setJobStep(ctx, job.ID, "deleting_project"); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM projects WHERE id = $1 AND is_active = false`, job.ProjectID); err != nil {
+		return fmt.Errorf("delete project: %w", err)
+	}
+	keyCache.InvalidateProject(job.ProjectID)
+	return nil
+}
+
+// deleteClickHouseLogs deletes the rows of the logs table that match where
+// with an ALTER TABLE ... DELETE mutation, which every ClickHouse version with
+// MergeTree supports, unlike lightweight DELETE. Mutations are applied in the
+// background, so the rows disappear shortly after this returns. The
+// log-processor's reconcile command deletes orphaned logs the same way.
+func deleteClickHouseLogs(ctx context.Context, conn clickhouse.Conn, where string, args ...any) error {
+	return conn.Exec(ctx, "ALTER TABLE logs DELETE WHERE "+where, args...)
+}
+
+// purgeCassandraLogs deletes the project's partition of the logs table. The
+// logs_by_id rows are keyed by log ID, so they are found through the
+// partition and deleted first.
+func purgeCassandraLogs(ctx context.Context, projectID string) error {
+	ids := make(chan gocql.UUID)
+	errs := make(chan error, purgeLookupWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < purgeLookupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				err := cassandra.Query(`DELETE FROM logs_by_id WHERE project_id = ? AND log_id = ?`, projectID, id).WithContext(ctx).Exec()
+				if err != nil {
+					errs <- fmt.Errorf("delete Cassandra lookup row: %w", err)
+					return
+				}
+			}
+		}()
+	}
+
+	var scanErr error
+	scanner := cassandra.Query(`SELECT log_id FROM logs WHERE project_id = ?`, projectID).WithContext(ctx).Iter().Scanner()
+scan:
+	for scanner.Next() {
+		var id gocql.UUID
+		if scanErr = scanner.Scan(&id); scanErr != nil {
+			break
+		}
+		select {
+		case ids <- id:
+		case scanErr = <-errs:
+			break scan
+		}
+	}
+	close(ids)
+	wg.Wait()
+	if err := scanner.Err(); scanErr == nil {
+		scanErr = err
+	}
+	if scanErr == nil && len(errs) > 0 {
+		scanErr = <-errs
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+
+	if err := cassandra.Query(`DELETE FROM logs WHERE project_id = ?`, projectID).WithContext(ctx).Exec(); err != nil {
+		return fmt.Errorf("delete Cassandra partition: %w", err)
+	}
+	return nil
+}
+
+// jobHandler reports the state of a job to the user who started it. Jobs
+// are looked up by ID alone, since the project may already be gone.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := sessionUserID(r)
+	if !ok {
+		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	jobID := mux.Vars(r)["jobId"]
+	if !isValidUUID(jobID) {
+		RespondWithError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	var job ProjectJob
+	var jobErr sql.NullString
+	var startedAt, finishedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, project_id, kind, status, step, error, attempts, run_after, created_at, started_at, finished_at
+		FROM project_jobs WHERE id = $1 AND created_by = $2
+	`, jobID, userID).Scan(&job.ID, &job.ProjectID, &job.Kind, &job.Status, &job.Step, &jobErr, &job.Attempts,
+		&job.RunAfter, &job.CreatedAt, &startedAt, &finishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusNotFound, "Job not found")
+		} else {
+			RespondWithError(w, http.StatusInternalServerError, "Database error on job fetch")
+		}
+		return
+	}
+	job.Error = jobErr.String
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	RespondWithJSON(w, http.StatusOK, job)
+}
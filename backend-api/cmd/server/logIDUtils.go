@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// maxIdempotencyKeyLength bounds client-supplied idempotency keys.
+const maxIdempotencyKeyLength = 255
+
+// assignLogID returns the ID a log is stored under: a time-based UUID for the
+// log's timestamp. With an idempotency key the rest of the UUID is derived
+// from the project and key, so a retried request gets the same ID and the
+// processor stores the log once. Without one it is random.
+func assignLogID(projectID string, logPayload *LogIngestionPayload) (gocql.UUID, error) {
+	if logPayload.IdempotencyKey == "" {
+		id := gocql.UUIDFromTime(logPayload.Timestamp)
+		if _, err := rand.Read(id[8:]); err != nil {
+			return gocql.UUID{}, fmt.Errorf("generate log ID: %w", err)
+		}
+		id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+		return id, nil
+	}
+	return deterministicLogID(logPayload.Timestamp, projectID+"/"+logPayload.IdempotencyKey), nil
+}
+
+// deterministicLogID returns a time-based UUID for ts whose clock sequence and
+// node are derived from seed.
+func deterministicLogID(ts time.Time, seed string) gocql.UUID {
+	id := gocql.UUIDFromTime(ts)
+	sum := sha256.Sum256([]byte(seed))
+	copy(id[8:], sum[:8])
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return id
+}
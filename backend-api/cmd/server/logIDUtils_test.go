@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestDeterministicLogID(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 535897900, time.UTC)
+	tests := []struct {
+		name     string
+		ts1, ts2 time.Time
+		seed1    string
+		seed2    string
+		wantSame bool
+	}{
+		{"same timestamp and seed", ts, ts, "p1/key", "p1/key", true},
+		{"other seed", ts, ts, "p1/key", "p1/other", false},
+		{"same key in another project", ts, ts, "p1/key", "p2/key", false},
+		{"other timestamp", ts, ts.Add(time.Microsecond), "p1/key", "p1/key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id1 := deterministicLogID(tt.ts1, tt.seed1)
+			id2 := deterministicLogID(tt.ts2, tt.seed2)
+			if (id1 == id2) != tt.wantSame {
+				t.Errorf("deterministicLogID() = %s and %s, want same = %v", id1, id2, tt.wantSame)
+			}
+			for _, id := range []gocql.UUID{id1, id2} {
+				if id.Version() != 1 || id.Variant() != gocql.VariantIETF {
+					t.Errorf("%s has version %d and variant %d, want a version 1 RFC 4122 UUID", id, id.Version(), id.Variant())
+				}
+			}
+			if got := id1.Time(); !got.Equal(tt.ts1.Truncate(100 * time.Nanosecond)) {
+				t.Errorf("Time() = %v, want %v", got, tt.ts1)
+			}
+		})
+	}
+}
+
+func TestAssignLogID(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+	keyed := func() *LogIngestionPayload { return &LogIngestionPayload{Timestamp: ts, IdempotencyKey: "retry-me"} }
+
+	first, err := assignLogID("p1", keyed())
+	if err != nil {
+		t.Fatalf("assignLogID() error = %v", err)
+	}
+	again, _ := assignLogID("p1", keyed())
+	if first != again {
+		t.Errorf("retried log got ID %s, want %s", again, first)
+	}
+	other, _ := assignLogID("p2", keyed())
+	if first == other {
+		t.Errorf("same idempotency key in another project got the same ID %s", other)
+	}
+
+	unkeyed := &LogIngestionPayload{Timestamp: ts}
+	a, _ := assignLogID("p1", unkeyed)
+	b, _ := assignLogID("p1", unkeyed)
+	if a == b {
+		t.Errorf("logs without an idempotency key got the same ID %s", a)
+	}
+	if !a.Time().Equal(ts) {
+		t.Errorf("Time() = %v, want %v", a.Time(), ts)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,6 +21,13 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	// payloadFetchWorkers bounds the concurrent Cassandra reads of one query.
+	payloadFetchWorkers = 16
+)
+
 type Log struct {
 	ID             string            `json:"id"`
 	ProjectID      string            `json:"project_id"`
@@ -41,10 +53,15 @@ type LogIngestionPayload struct {
 	Timestamp      time.Time         `json:"timestamp"`
 	SearchableKeys map[string]string `json:"searchable_keys"`
 	FullPayload    json.RawMessage   `json:"full_payload"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+
+	// schemaCheck is counted in the schema's stats once the log is accepted.
+	schemaCheck *schemaCheck
 }
 
 type KafkaLogMessage struct {
 	ProjectID string          `json:"project_id"`
+	LogID     string          `json:"log_id"`
 	Payload   json.RawMessage `json:"payload"`
 }
 
@@ -53,73 +70,164 @@ func logIngestionHandler(w http.ResponseWriter, r *http.Request) {
 	projectID := vars["projectId"]
 	apiKey := r.Header.Get("X-API-KEY")
 
-	// Validate API Key
-	var dbProjectID string
-	err := db.QueryRow("SELECT id FROM projects WHERE id = $1 AND api_key = $2", projectID, apiKey).Scan(&dbProjectID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusUnauthorized, "Invalid API Key for this project")
-		} else {
-			log.Printf("API Key validation DB error: %v", err)
-			RespondWithError(w, http.StatusInternalServerError, "Error validating API key")
-		}
+	project, ok := validateAPIKey(w, projectID, apiKey, APIKeyScopeIngest)
+	if !ok {
 		return
 	}
 
 	// Read and validate the log payload
+	if err := openBody(w, r, project); err != nil {
+		respondWithBodyError(w, err)
+		return
+	}
+	defer r.Body.Close()
 	var logPayload LogIngestionPayload
 	if err := json.NewDecoder(r.Body).Decode(&logPayload); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Invalid request payload: "+err.Error())
+		respondWithBodyError(w, err)
 		return
 	}
-	defer r.Body.Close()
+	if logPayload.IdempotencyKey == "" {
+		logPayload.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	}
 
-	if logPayload.Name == "" || logPayload.Timestamp.IsZero() {
-		RespondWithError(w, http.StatusBadRequest, "Missing required fields: name and timestamp must be provided")
+	if err := validateLogPayload(r.Context(), &logPayload, project); err != nil {
+		RespondWithError(w, validationErrorStatus(err), err.Error())
 		return
 	}
 
-	// Re-marshal the validated payload to be sent to Kafka
-	payloadBytes, err := json.Marshal(logPayload)
+	logID, err := assignLogID(projectID, &logPayload)
+	if err != nil {
+		requestLogger(r).Error("Failed to assign log ID", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to process log")
+		return
+	}
+	msg, err := buildKafkaMessage(projectID, logID, requestID(r), &logPayload)
+	if err != nil {
+		if status := validationErrorStatus(err); status == http.StatusRequestEntityTooLarge {
+			RespondWithError(w, status, err.Error())
+			return
+		}
+		requestLogger(r).Error("Failed to build Kafka message", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to process log")
+		return
+	}
+
+	grant, ok := enforceIngestionLimits(w, r, project, 1)
+	if !ok {
+		return
+	}
+
+	// Write the message to Kafka
+	err = nextKafkaWriter().WriteMessages(r.Context(), msg)
 	if err != nil {
-		log.Printf("Failed to re-marshal log payload: %v", err)
+		kafkaProduceErrors.Inc()
+		grant.Release(1)
+		requestLogger(r).Error("Failed to write message to Kafka", "project_id", projectID, "log_id", logID.String(), "error", err)
 		RespondWithError(w, http.StatusInternalServerError, "Failed to process log")
 		return
 	}
 
+	logsAccepted.WithLabelValues(projectLabels.Label(projectID)).Inc()
+	usageCounter.Record(projectID, 1)
+	schemaStats.Record(logPayload.schemaCheck)
+	RespondWithJSON(w, http.StatusAccepted, map[string]string{"status": "log accepted", "log_id": logID.String()})
+}
+
+// validateLogPayload checks a log against the project's settings, limits and
+// the schema registered for its event name.
+func validateLogPayload(ctx context.Context, logPayload *LogIngestionPayload, project *IngestionProject) error {
+	if logPayload.Name == "" || logPayload.Timestamp.IsZero() {
+		return fmt.Errorf("Missing required fields: name and timestamp must be provided")
+	}
+	if len(logPayload.IdempotencyKey) > maxIdempotencyKeyLength {
+		return fmt.Errorf("Idempotency key exceeds %d characters", maxIdempotencyKeyLength)
+	}
+	if err := applySearchableKeysPolicy(logPayload, project); err != nil {
+		return err
+	}
+	if err := checkPayloadLimits(logPayload, project.PayloadLimits); err != nil {
+		return err
+	}
+	return checkEventSchema(ctx, logPayload, project)
+}
+
+// applySearchableKeysPolicy checks the payload's searchable keys against the
+// keys declared on the project and rejects or drops undeclared ones
+// according to the project's policy.
+func applySearchableKeysPolicy(logPayload *LogIngestionPayload, project *IngestionProject) error {
+	if project.SearchableKeysPolicy == SearchableKeysPolicyAllow {
+		return nil
+	}
+
+	var undeclared []string
+	for key := range logPayload.SearchableKeys {
+		if !project.SearchableKeys[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+	if len(undeclared) == 0 {
+		return nil
+	}
+
+	if project.SearchableKeysPolicy == SearchableKeysPolicyDrop {
+		for _, key := range undeclared {
+			delete(logPayload.SearchableKeys, key)
+		}
+		return nil
+	}
+	sort.Strings(undeclared)
+	return fmt.Errorf("Undeclared searchable keys: %s", strings.Join(undeclared, ", "))
+}
+
+// buildKafkaMessage encodes a validated log as a Kafka message. It returns a
+// *PayloadTooLargeError if the message would not fit in maxKafkaMessageBytes.
+func buildKafkaMessage(projectID string, logID gocql.UUID, requestID string, logPayload *LogIngestionPayload) (kafka.Message, error) {
+	// Re-marshal the validated payload to be sent to Kafka
+	payloadBytes, err := marshalJSON(logPayload)
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("re-marshal log payload: %w", err)
+	}
+
 	// Create the structured message for Kafka
 	kafkaMsg := KafkaLogMessage{
 		ProjectID: projectID,
+		LogID:     logID.String(),
 		Payload:   json.RawMessage(payloadBytes),
 	}
 
-	kafkaMsgBytes, err := json.Marshal(kafkaMsg)
+	kafkaMsgBytes, err := marshalJSON(kafkaMsg)
 	if err != nil {
-		log.Printf("Failed to marshal Kafka message: %v", err)
-		RespondWithError(w, http.StatusInternalServerError, "Failed to process log")
-		return
+		return kafka.Message{}, fmt.Errorf("marshal Kafka message: %w", err)
 	}
 
-	// Construct the message for Kafka
 	// We use the project ID as the key to ensure logs for the same project go to the same partition
 	msg := kafka.Message{
-		Key:   []byte(projectID),
-		Value: kafkaMsgBytes,
+		Key:     []byte(projectID),
+		Value:   kafkaMsgBytes,
+		Headers: []kafka.Header{{Key: kafkaRequestIDHeader, Value: []byte(requestID)}},
 	}
+	if size := len(msg.Key) + len(msg.Value) + len(kafkaRequestIDHeader) + len(requestID); size > maxKafkaMessageBytes {
+		return kafka.Message{}, &PayloadTooLargeError{Message: fmt.Sprintf("Log is %d bytes once encoded, over the maximum of %d bytes", size, maxKafkaMessageBytes)}
+	}
+	return msg, nil
+}
 
-	// Round-robin selection of Kafka writer
-	writerIndex := atomic.AddInt64(&logCounter, 1) % int64(len(kafkaWriters))
-	kafkaWriter := kafkaWriters[writerIndex]
-
-	// Write the message to Kafka
-	err = kafkaWriter.WriteMessages(r.Context(), msg)
-	if err != nil {
-		log.Printf("Failed to write message to Kafka: %v", err)
-		RespondWithError(w, http.StatusInternalServerError, "Failed to process log")
-		return
+// marshalJSON is json.Marshal without HTML escaping, which would blow up
+// payloads full of '<', '>' and '&' to six times their size.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
 	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
 
-	RespondWithJSON(w, http.StatusAccepted, map[string]string{"status": "log accepted"})
+// nextKafkaWriter picks a Kafka writer round-robin.
+func nextKafkaWriter() *kafka.Writer {
+	writerIndex := atomic.AddInt64(&logCounter, 1) % int64(len(kafkaWriters))
+	return kafkaWriters[writerIndex]
 }
 
 type AggregatedLog struct {
@@ -129,25 +237,11 @@ type AggregatedLog struct {
 }
 
 func getAggregatedLogsHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "logsys-session")
-	userID, ok := session.Values["user_id"].(string)
-	if !ok {
-		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
 	vars := mux.Vars(r)
 	projectID := vars["projectId"]
 
-	// Check if user has access to the project
-	var accessCheck int
-	err := db.QueryRow("SELECT 1 FROM user_project_access WHERE user_id = $1 AND project_id = $2", userID, projectID).Scan(&accessCheck)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusForbidden, "You do not have access to this project")
-		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Database error on access check")
-		}
+	// Check if the caller may read the project's logs
+	if !requireLogReadAccess(w, r, projectID, PermissionReadAggregates) {
 		return
 	}
 
@@ -220,25 +314,11 @@ func getAggregatedLogsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func queryLogsHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "logsys-session")
-	userID, ok := session.Values["user_id"].(string)
-	if !ok {
-		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
 	vars := mux.Vars(r)
 	projectID := vars["projectId"]
 
-	// Check if user has access to the project
-	var accessCheck int
-	err := db.QueryRow("SELECT 1 FROM user_project_access WHERE user_id = $1 AND project_id = $2", userID, projectID).Scan(&accessCheck)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusForbidden, "You do not have access to this project")
-		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Database error on access check")
-		}
+	// Check if the caller may read the project's logs
+	if !requireLogReadAccess(w, r, projectID, PermissionReadLogs) {
 		return
 	}
 
@@ -248,6 +328,9 @@ func queryLogsHandler(w http.ResponseWriter, r *http.Request) {
 	searchKeysStr := r.URL.Query().Get("search_keys")
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
+	cursorStr := r.URL.Query().Get("cursor")
+	// include_payload=false returns only the ClickHouse metadata and skips Cassandra
+	includePayload := r.URL.Query().Get("include_payload") != "false"
 
 	var args []interface{}
 	sql := "SELECT log_id, event_name, event_timestamp, searchable_keys FROM logs WHERE project_id = ?"
@@ -288,12 +371,32 @@ func queryLogsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	limit := 100
+	if cursorStr != "" {
+		if offsetStr != "" {
+			RespondWithError(w, http.StatusBadRequest, "cursor and offset cannot be combined")
+			return
+		}
+		cursor, err := decodeLogCursor(cursorStr)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		// Continue right after the last log of the previous page
+		sql += " AND (event_timestamp < toDateTime(?) OR (event_timestamp = toDateTime(?) AND log_id > toUUID(?)))"
+		args = append(args, cursor.Timestamp, cursor.Timestamp, cursor.LogID)
+	}
+
+	limit := defaultQueryLimit
 	if limitStr != "" {
 		limit, _ = strconv.Atoi(limitStr)
 	}
-	sql += " LIMIT ?"
-	args = append(args, limit)
+	if limit <= 0 || limit > maxQueryLimit {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxQueryLimit))
+		return
+	}
+	// Fetch one extra row to learn whether another page exists
+	sql += " ORDER BY event_timestamp DESC, log_id LIMIT ?"
+	args = append(args, limit+1)
 
 	if offsetStr != "" {
 		offset, _ := strconv.Atoi(offsetStr)
@@ -316,22 +419,116 @@ func queryLogsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logItem.ProjectID = projectID
+		logs = append(logs, logItem)
+	}
+	if err := rows.Err(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to read logs from ClickHouse")
+		return
+	}
 
-		// Fetch the full payload from Cassandra
-		var payloadStr string
-		if err := cassandra.Query("SELECT payload FROM logs WHERE project_id = ? AND event_timestamp = ? AND log_id = ?",
-			logItem.ProjectID, logItem.Timestamp, logItem.ID).Scan(&payloadStr); err != nil {
-			if err != gocql.ErrNotFound {
-				log.Printf("Failed to query log payload from Cassandra: %v", err)
-			}
-		} else {
-			logItem.Payload = json.RawMessage(payloadStr)
-		}
+	resp := LogPage{Logs: logs}
+	if len(logs) > limit {
+		resp.Logs = logs[:limit]
+		resp.HasMore = true
+		last := resp.Logs[limit-1]
+		resp.NextCursor = encodeLogCursor(logCursor{Timestamp: last.Timestamp.Unix(), LogID: last.ID})
+	}
 
-		logs = append(logs, logItem)
+	if includePayload {
+		fetchPayloads(r.Context(), resp.Logs)
 	}
 
-	RespondWithJSON(w, http.StatusOK, logs)
+	RespondWithJSON(w, http.StatusOK, resp)
+}
+
+// LogPage is one page of log search results. NextCursor is passed back as
+// the cursor parameter to read the following page.
+type LogPage struct {
+	Logs       []Log  `json:"logs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// logCursor is the position of the last log of a page in the
+// (event_timestamp DESC, log_id) search order.
+type logCursor struct {
+	Timestamp int64  `json:"t"`
+	LogID     string `json:"id"`
+}
+
+func encodeLogCursor(c logCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeLogCursor(s string) (logCursor, error) {
+	var c logCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if _, err := gocql.ParseUUID(c.LogID); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// eventSecond returns the window [from, to) of Cassandra event timestamps a
+// timestamp can stand for. ClickHouse keeps event timestamps to the second
+// while Cassandra keeps milliseconds, so a log is looked up by the second it
+// happened in and picked out of it by its ID.
+func eventSecond(t time.Time) (from, to time.Time) {
+	from = t.Truncate(time.Second)
+	return from, from.Add(time.Second)
+}
+
+// readLogPayload reads the event name and payload of a log from its
+// project's Cassandra partition. It returns gocql.ErrNotFound if the log is
+// not there.
+func readLogPayload(ctx context.Context, projectID string, eventTime time.Time, logID gocql.UUID) (eventName, payload string, err error) {
+	from, to := eventSecond(eventTime)
+	err = cassandra.Query(`SELECT event_name, payload FROM logs
+		WHERE project_id = ? AND event_timestamp >= ? AND event_timestamp < ? AND log_id = ? ALLOW FILTERING`,
+		projectID, from, to, logID).WithContext(ctx).Scan(&eventName, &payload)
+	return eventName, payload, err
+}
+
+// fetchPayloads fills in the full payload of each log from Cassandra, using
+// up to payloadFetchWorkers concurrent queries. Logs whose payload cannot be
+// read are left without one.
+func fetchPayloads(ctx context.Context, logs []Log) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	workers := min(payloadFetchWorkers, len(logs))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				logItem := &logs[i]
+				logUUID, err := gocql.ParseUUID(logItem.ID)
+				if err != nil {
+					continue
+				}
+				_, payloadStr, err := readLogPayload(ctx, logItem.ProjectID, logItem.Timestamp, logUUID)
+				if err != nil {
+					if err != gocql.ErrNotFound {
+						slog.Error("Failed to query log payload from Cassandra", "project_id", logItem.ProjectID, "log_id", logItem.ID, "error", err)
+					}
+					continue
+				}
+				logItem.Payload = json.RawMessage(payloadStr)
+			}
+		}()
+	}
+	for i := range logs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 }
 
 func parseSearchKeys(searchKeysStr string) (map[string]string, error) {
@@ -348,41 +545,105 @@ func parseSearchKeys(searchKeysStr string) (map[string]string, error) {
 }
 
 func getLogHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "logsys-session")
-	userID, ok := session.Values["user_id"].(string)
-	if !ok {
-		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
 	vars := mux.Vars(r)
 	projectID := vars["projectId"]
 	logID := vars["logId"]
 
-	// Check if user has access to the project
-	var accessCheck int
-	err := db.QueryRow("SELECT 1 FROM user_project_access WHERE user_id = $1 AND project_id = $2", userID, projectID).Scan(&accessCheck)
+	// Check if the caller may read the project's logs
+	if !requireLogReadAccess(w, r, projectID, PermissionReadLogs) {
+		return
+	}
+
+	// Log IDs are TimeUUIDs; anything else cannot exist
+	logUUID, err := gocql.ParseUUID(logID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusForbidden, "You do not have access to this project")
-		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Database error on access check")
+		RespondWithError(w, http.StatusNotFound, "Log not found")
+		return
+	}
+
+	// Resolve the log's position in its project's partition. The lookup is
+	// keyed by project, so logs of other projects are never found.
+	logItem := Log{ID: logID, ProjectID: projectID}
+	err = cassandra.Query("SELECT event_timestamp FROM logs_by_id WHERE project_id = ? AND log_id = ?",
+		projectID, logUUID).Scan(&logItem.Timestamp)
+	if err == gocql.ErrNotFound {
+		// Logs stored before the lookup table existed have no row in it.
+		found, err := findUnindexedLog(r.Context(), &logItem, logUUID)
+		if err != nil {
+			requestLogger(r).Error("Failed to query unindexed log", "project_id", projectID, "log_id", logID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to query log from Cassandra")
+			return
 		}
+		if !found {
+			RespondWithError(w, http.StatusNotFound, "Log not found")
+			return
+		}
+		RespondWithJSON(w, http.StatusOK, logItem)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Failed to query log lookup from Cassandra", "project_id", projectID, "log_id", logID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to query log from Cassandra")
 		return
 	}
 
-	var log Log
-	if err := cassandra.Query("SELECT project_id, event_name, event_timestamp, payload FROM logs WHERE log_id = ?", logID).Scan(&log.ProjectID, &log.EventName, &log.Timestamp, &log.Payload); err != nil {
+	eventName, payloadStr, err := readLogPayload(r.Context(), projectID, logItem.Timestamp, logUUID)
+	if err != nil {
 		if err == gocql.ErrNotFound {
 			RespondWithError(w, http.StatusNotFound, "Log not found")
 		} else {
+			requestLogger(r).Error("Failed to query log from Cassandra", "project_id", projectID, "log_id", logID, "error", err)
 			RespondWithError(w, http.StatusInternalServerError, "Failed to query log from Cassandra")
 		}
 		return
 	}
-	log.ID = logID
+	logItem.EventName = eventName
+	logItem.Payload = json.RawMessage(payloadStr)
+
+	RespondWithJSON(w, http.StatusOK, logItem)
+}
+
+// findUnindexedLog reads a log that has no logs_by_id row, because it was
+// stored before that table existed. ClickHouse gives the second the log's
+// event happened in, which bounds the scan of its Cassandra partition. The
+// missing lookup row is written back, expiring with the log, so the next read
+// takes the fast path.
+func findUnindexedLog(ctx context.Context, logItem *Log, logUUID gocql.UUID) (bool, error) {
+	var eventTime time.Time
+	err := chConn.QueryRow(ctx, "SELECT event_timestamp, event_name FROM logs WHERE project_id = ? AND log_id = toUUID(?) LIMIT 1",
+		logItem.ProjectID, logItem.ID).Scan(&eventTime, &logItem.EventName)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("query ClickHouse: %w", err)
+	}
 
-	RespondWithJSON(w, http.StatusOK, log)
+	from, to := eventSecond(eventTime)
+	var eventName *string
+	var payloadStr string
+	var ttl int
+	err = cassandra.Query(`SELECT event_timestamp, event_name, payload, TTL(payload) FROM logs
+		WHERE project_id = ? AND event_timestamp >= ? AND event_timestamp < ? AND log_id = ? ALLOW FILTERING`,
+		logItem.ProjectID, from, to, logUUID).WithContext(ctx).
+		Scan(&logItem.Timestamp, &eventName, &payloadStr, &ttl)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("query Cassandra: %w", err)
+	}
+	// Rows older still were written without their event name.
+	if eventName != nil {
+		logItem.EventName = *eventName
+	}
+	logItem.Payload = json.RawMessage(payloadStr)
+
+	if err := cassandra.Query(`INSERT INTO logs_by_id (project_id, log_id, event_timestamp) VALUES (?, ?, ?) USING TTL ?`,
+		logItem.ProjectID, logUUID, logItem.Timestamp, ttl).WithContext(ctx).Exec(); err != nil {
+		slog.Warn("Failed to backfill log lookup row", "project_id", logItem.ProjectID, "log_id", logItem.ID, "error", err)
+	}
+	return true, nil
 }
 
 func parseAndFormatTime(timeStr string) (string, error) {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplySearchableKeysPolicy(t *testing.T) {
+	declared := map[string]bool{"user_id": true, "region": true}
+	tests := []struct {
+		name     string
+		policy   string
+		keys     map[string]string
+		wantKeys map[string]string
+		wantErr  string
+	}{
+		{
+			name:     "allow keeps undeclared keys",
+			policy:   SearchableKeysPolicyAllow,
+			keys:     map[string]string{"user_id": "1", "other": "x"},
+			wantKeys: map[string]string{"user_id": "1", "other": "x"},
+		},
+		{
+			name:     "reject accepts declared keys",
+			policy:   SearchableKeysPolicyReject,
+			keys:     map[string]string{"user_id": "1", "region": "eu"},
+			wantKeys: map[string]string{"user_id": "1", "region": "eu"},
+		},
+		{
+			name:    "reject lists undeclared keys in order",
+			policy:  SearchableKeysPolicyReject,
+			keys:    map[string]string{"user_id": "1", "zone": "a", "other": "x"},
+			wantErr: "Undeclared searchable keys: other, zone",
+		},
+		{
+			name:     "drop removes undeclared keys",
+			policy:   SearchableKeysPolicyDrop,
+			keys:     map[string]string{"user_id": "1", "zone": "a", "other": "x"},
+			wantKeys: map[string]string{"user_id": "1"},
+		},
+		{
+			name:     "no keys",
+			policy:   SearchableKeysPolicyReject,
+			keys:     nil,
+			wantKeys: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project := &IngestionProject{SearchableKeys: declared, SearchableKeysPolicy: tt.policy}
+			logPayload := &LogIngestionPayload{SearchableKeys: tt.keys}
+			err := applySearchableKeysPolicy(logPayload, project)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("applySearchableKeysPolicy() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applySearchableKeysPolicy() error = %v", err)
+			}
+			if !reflect.DeepEqual(logPayload.SearchableKeys, tt.wantKeys) {
+				t.Errorf("searchable keys = %v, want %v", logPayload.SearchableKeys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLogCursorRoundTrip(t *testing.T) {
+	tests := []logCursor{
+		{Timestamp: 1700000000, LogID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{Timestamp: 0, LogID: "00000000-0000-1000-8000-000000000000"},
+		{Timestamp: -1, LogID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+	}
+	for _, want := range tests {
+		encoded := encodeLogCursor(want)
+		got, err := decodeLogCursor(encoded)
+		if err != nil {
+			t.Fatalf("decodeLogCursor(%q) error = %v", encoded, err)
+		}
+		if got != want {
+			t.Errorf("decodeLogCursor(encodeLogCursor(%+v)) = %+v", want, got)
+		}
+	}
+}
+
+func TestDecodeLogCursorRejects(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not a cursor!"},
+		{"not JSON", encode("cursor")},
+		{"wrong types", encode(`{"t":"yesterday","id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}`)},
+		{"missing log ID", encode(`{"t":1}`)},
+		{"log ID is not a UUID", encode(`{"t":1,"id":"' OR 1=1 --"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := decodeLogCursor(tt.cursor); err == nil {
+				t.Errorf("decodeLogCursor(%q) = %+v, want an error", tt.cursor, c)
+			}
+		})
+	}
+}
+
+func TestEventSecond(t *testing.T) {
+	// As stored in Cassandra, and as read back from ClickHouse's DateTime.
+	stored := time.Date(2025, 3, 14, 15, 9, 26, 535*int(time.Millisecond), time.UTC)
+	fromClickHouse := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+	for _, ts := range []time.Time{stored, fromClickHouse} {
+		from, to := eventSecond(ts)
+		if stored.Before(from) || !stored.Before(to) {
+			t.Errorf("eventSecond(%v) = [%v, %v), want it to contain %v", ts, from, to, stored)
+		}
+		if to.Sub(from) != time.Second {
+			t.Errorf("eventSecond(%v) spans %v, want one second", ts, to.Sub(from))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// requestIDHeader carries a request's ID from and back to the client.
+	requestIDHeader = "X-Request-ID"
+	// kafkaRequestIDHeader carries the ID of the request that produced a
+	// message to the processor.
+	kafkaRequestIDHeader = "request-id"
+	// maxRequestIDLength bounds client-supplied request IDs; longer ones are
+	// replaced with a generated ID.
+	maxRequestIDLength = 128
+)
+
+type contextKey int
+
+const requestIDContextKey contextKey = iota
+
+// newLoggerFromEnv builds the process logger. LOG_LEVEL is one of debug, info
+// (the default), warn or error; LOG_FORMAT is json (the default) or text.
+func newLoggerFromEnv() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDMiddleware makes sure every request has an ID. A valid X-Request-ID
+// sent by the client is kept, otherwise one is generated. The ID is echoed in
+// the response and stored in the request context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID requestIDMiddleware assigned to r.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestLogger returns a logger that tags every line with r's request ID.
+func requestLogger(r *http.Request) *slog.Logger {
+	return slog.Default().With("request_id", requestID(r))
+}
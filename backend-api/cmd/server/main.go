@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -13,9 +17,14 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
 )
 
+// defaultShutdownTimeout is how long a shutdown may take unless
+// SHUTDOWN_TIMEOUT_SECONDS says otherwise.
+const defaultShutdownTimeout = 20 * time.Second
+
 var (
 	db           *sql.DB
 	store        *sessions.CookieStore
@@ -23,6 +32,7 @@ var (
 	logCounter   int64
 	chConn       clickhouse.Conn
 	cassandra    *gocql.Session
+	keyCache     *apiKeyCache
 )
 
 type User struct {
@@ -35,18 +45,36 @@ type Project struct {
 	Name           string   `json:"name"`
 	APIKey         string   `json:"api_key,omitempty"`
 	SearchableKeys []string `json:"searchable_keys,omitempty"`
-	LogTTLSeconds  int      `json:"log_ttl_seconds"`
-	OwnerID        string   `json:"owner_id"`
-	Description    string   `json:"description,omitempty"`
+	// SearchableKeysPolicy decides what happens to searchable keys that are
+	// not declared in SearchableKeys: "reject", "drop" or "allow".
+	SearchableKeysPolicy string `json:"searchable_keys_policy"`
+	LogTTLSeconds        int    `json:"log_ttl_seconds"`
+	// RateLimitPerSecond, RateLimitBurst and DailyLogQuota limit ingestion;
+	// 0 means unlimited, and a burst of 0 means RateLimitPerSecond.
+	RateLimitPerSecond int   `json:"rate_limit_per_second"`
+	RateLimitBurst     int   `json:"rate_limit_burst"`
+	DailyLogQuota      int64 `json:"daily_log_quota"`
+	// The payload limits bound what each ingested log may contain; 0 or an
+	// empty pattern means the server default.
+	MaxBodyBytes             int64  `json:"max_body_bytes"`
+	MaxPayloadBytes          int    `json:"max_payload_bytes"`
+	MaxSearchableKeys        int    `json:"max_searchable_keys"`
+	MaxSearchableValueLength int    `json:"max_searchable_value_length"`
+	EventNamePattern         string `json:"event_name_pattern,omitempty"`
+	OwnerID                  string `json:"owner_id"`
+	Description              string `json:"description,omitempty"`
+	// Role is the requesting user's role in the project.
+	Role string `json:"role,omitempty"`
 }
 
 func main() {
-	log.Println("Starting Backend API server...")
+	slog.SetDefault(newLoggerFromEnv())
+	slog.Info("Starting Backend API server")
 	var err error
 
 	sessionKey := os.Getenv("SESSION_KEY")
 	if sessionKey == "" {
-		log.Fatal("SESSION_KEY not set.")
+		fatal("SESSION_KEY not set")
 	}
 	store = sessions.NewCookieStore([]byte(sessionKey))
 	store.Options = &sessions.Options{
@@ -57,7 +85,7 @@ func main() {
 
 	cockroachDBURL := os.Getenv("COCKROACHDB_URL")
 	if cockroachDBURL == "" {
-		log.Fatal("COCKROACHDB_URL not set.")
+		fatal("COCKROACHDB_URL not set")
 	}
 
 	maxRetries := 10
@@ -69,27 +97,35 @@ func main() {
 				break
 			}
 		}
-		log.Printf("Failed to connect to CockroachDB (attempt %d/%d): %v. Retrying in 5 seconds...", i+1, maxRetries, err)
+		slog.Warn("Failed to connect to CockroachDB, retrying in 5 seconds", "attempt", i+1, "max_attempts", maxRetries, "error", err)
 		time.Sleep(5 * time.Second)
 	}
 	if err != nil {
-		log.Fatalf("Failed to connect to CockroachDB after %d retries: %v", maxRetries, err)
+		fatal("Failed to connect to CockroachDB", "attempts", maxRetries, "error", err)
 	}
-	log.Println("Successfully connected to CockroachDB.")
+	slog.Info("Successfully connected to CockroachDB")
+
+	keyCache = newAPIKeyCacheFromEnv()
+	slog.Info("API key cache configured", "size", keyCache.size, "ttl", keyCache.ttl)
 
 	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKER"), ",")
 	if len(kafkaBrokers) == 0 {
-		log.Fatal("KAFKA_BROKER not set.")
+		fatal("KAFKA_BROKER not set")
+	}
+	kafkaCompression, err := kafkaCompressionFromEnv()
+	if err != nil {
+		fatal("Invalid KAFKA_COMPRESSION", "error", err)
 	}
 	for _, broker := range kafkaBrokers {
 		writer := &kafka.Writer{
-			Addr:     kafka.TCP(broker),
-			Topic:    "log-events",
-			Balancer: &kafka.LeastBytes{},
+			Addr:        kafka.TCP(broker),
+			Topic:       "log-events",
+			Balancer:    &kafka.LeastBytes{},
+			Compression: kafkaCompression,
 		}
 		kafkaWriters = append(kafkaWriters, writer)
 	}
-	log.Printf("Kafka writers configured for brokers at %s", os.Getenv("KAFKA_BROKER"))
+	slog.Info("Kafka writers configured", "brokers", os.Getenv("KAFKA_BROKER"), "compression", kafkaCompression.String())
 
 	clickhouseHost := os.Getenv("CLICKHOUSE_HOST")
 	if clickhouseHost == "" {
@@ -105,9 +141,9 @@ func main() {
 		MaxIdleConns: 5,
 	})
 	if err != nil {
-		log.Fatalf("Failed to connect to ClickHouse: %v", err)
+		fatal("Failed to connect to ClickHouse", "error", err)
 	}
-	log.Println("Successfully connected to ClickHouse.")
+	slog.Info("Successfully connected to ClickHouse")
 
 	cassandraHost := os.Getenv("CASSANDRA_HOSTS")
 	if cassandraHost == "" {
@@ -117,12 +153,16 @@ func main() {
 	cluster.Keyspace = "logsystem"
 	cassandra, err = cluster.CreateSession()
 	if err != nil {
-		log.Fatalf("Failed to connect to Cassandra: %v", err)
+		fatal("Failed to connect to Cassandra", "error", err)
 	}
-	log.Println("Successfully connected to Cassandra.")
+	slog.Info("Successfully connected to Cassandra")
 
 	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
 	r.HandleFunc("/health", HealthCheckHandler).Methods("GET")
+	r.HandleFunc("/health/live", liveHandler).Methods("GET")
+	r.HandleFunc("/health/ready", readyHandler).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	apiRouter := r.PathPrefix("/api").Subrouter()
 	apiRouter.HandleFunc("/users", createUserHandler).Methods("POST")
@@ -130,10 +170,22 @@ func main() {
 	apiRouter.HandleFunc("/auth/logout", logoutHandler).Methods("POST")
 	apiRouter.HandleFunc("/auth/me", meHandler).Methods("GET")
 	apiRouter.HandleFunc("/projects", projectsHandler).Methods("GET", "POST")
+	apiRouter.HandleFunc("/projects/{projectId}", projectHandler).Methods("PATCH", "DELETE")
 	apiRouter.HandleFunc("/projects/{projectId}/apikey", getProjectAPIKeyHandler).Methods("GET")
-	apiRouter.HandleFunc("/projects/{projectId}/logs", logsHandler).Methods("GET", "POST")
+	apiRouter.HandleFunc("/projects/{projectId}/apikeys", apiKeysHandler).Methods("GET", "POST")
+	apiRouter.HandleFunc("/projects/{projectId}/apikeys/{keyId}", apiKeyHandler).Methods("PATCH", "DELETE")
+	apiRouter.HandleFunc("/projects/{projectId}/apikeys/{keyId}/rotate", rotateAPIKeyHandler).Methods("POST")
+	apiRouter.HandleFunc("/projects/{projectId}/usage", usageHandler).Methods("GET")
+	apiRouter.HandleFunc("/projects/{projectId}/schemas", eventSchemasHandler).Methods("GET")
+	apiRouter.HandleFunc("/projects/{projectId}/schemas/{eventName:.+}", eventSchemaHandler).Methods("GET", "PUT", "DELETE")
+	apiRouter.HandleFunc("/projects/{projectId}/members", membersHandler).Methods("GET", "POST")
+	apiRouter.HandleFunc("/projects/{projectId}/members/{userId}", memberHandler).Methods("PATCH", "DELETE")
+	apiRouter.HandleFunc("/projects/{projectId}/transfer-ownership", transferOwnershipHandler).Methods("POST")
+	apiRouter.HandleFunc("/projects/{projectId}/logs", instrumentIngestion("single", logsHandler)).Methods("GET", "POST")
+	apiRouter.HandleFunc("/projects/{projectId}/logs/batch", instrumentIngestion("batch", logBatchIngestionHandler)).Methods("POST")
 	apiRouter.HandleFunc("/projects/{projectId}/logs/aggregated", getAggregatedLogsHandler).Methods("GET")
 	apiRouter.HandleFunc("/projects/{projectId}/logs/{logId}", getLogHandler).Methods("GET")
+	apiRouter.HandleFunc("/jobs/{jobId}", jobHandler).Methods("GET")
 
 	port := os.Getenv("BACKEND_API_PORT")
 	if port == "" {
@@ -147,6 +199,63 @@ func main() {
 		ReadTimeout:  15 * time.Second,
 	}
 
-	log.Printf("Backend API listening on port %s", port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		slog.Info("Backend API listening", "port", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	jobs.Start(ctx)
+	usageCounter.Start(ctx)
+	schemaStats.Start(ctx)
+	<-ctx.Done()
+	stop()
+	shutdown(srv, shutdownTimeoutFromEnv())
+}
+
+// shutdownTimeoutFromEnv reads SHUTDOWN_TIMEOUT_SECONDS, the time allowed to
+// drain requests and flush Kafka writes after a shutdown signal.
+func shutdownTimeoutFromEnv() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS")); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// shutdown stops accepting connections, waits for in-flight requests (and the
+// Kafka writes they make) and the job runner to finish, flushes usage counts
+// and schema stats, then closes the Kafka writers and the database
+// connections. Whatever is still running when timeout expires is abandoned.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	slog.Info("Shutting down, draining requests", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP server did not drain in time", "error", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		jobs.Wait()
+		usageCounter.Wait()
+		schemaStats.Wait()
+		for _, writer := range kafkaWriters {
+			if err := writer.Close(); err != nil {
+				slog.Error("Failed to close Kafka writer", "error", err)
+			}
+		}
+		cassandra.Close()
+		chConn.Close()
+		db.Close()
+	}()
+	select {
+	case <-done:
+		slog.Info("Backend API stopped")
+	case <-ctx.Done():
+		slog.Warn("Shutdown deadline exceeded, exiting")
+	}
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type ProjectMember struct {
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	FullName   string    `json:"full_name,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Role       string    `json:"role"`
+	IsOwner    bool      `json:"is_owner"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// AddMemberRequest names the user to add by exactly one of Username or Email.
+type AddMemberRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"user_id"`
+}
+
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+
+	switch r.Method {
+	case "GET":
+		if _, _, ok := authorizeProject(w, r, projectID, PermissionViewProject); !ok {
+			return
+		}
+		listMembersHandler(w, r, projectID)
+	case "POST":
+		if _, _, ok := authorizeProject(w, r, projectID, PermissionManageMembers); !ok {
+			return
+		}
+		addMemberHandler(w, r, projectID)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func listMembersHandler(w http.ResponseWriter, r *http.Request, projectID string) {
+	rows, err := db.Query(`
+		SELECT u.id, u.username, u.full_name, u.email, upa.role, u.id = p.owner_id, upa.assigned_at
+		FROM user_project_access upa
+		JOIN users u ON u.id = upa.user_id
+		JOIN projects p ON p.id = upa.project_id
+		WHERE upa.project_id = $1
+		ORDER BY upa.assigned_at, u.username
+	`, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	members := []ProjectMember{}
+	for rows.Next() {
+		var m ProjectMember
+		var fullName, email sql.NullString
+		if err := rows.Scan(&m.UserID, &m.Username, &fullName, &email, &m.Role, &m.IsOwner, &m.AssignedAt); err != nil {
+			requestLogger(r).Error("Failed to scan project member", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to scan project member")
+			return
+		}
+		m.FullName = fullName.String
+		m.Email = email.String
+		members = append(members, m)
+	}
+
+	RespondWithJSON(w, http.StatusOK, members)
+}
+
+// addMemberHandler gives an existing user access to the project. The user is
+// looked up by username or email; the role defaults to member.
+func addMemberHandler(w http.ResponseWriter, r *http.Request, projectID string) {
+	var req AddMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if (req.Username == "") == (req.Email == "") {
+		RespondWithError(w, http.StatusBadRequest, "Exactly one of username or email is required")
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleMember
+	}
+	if !isValidRole(req.Role) {
+		RespondWithError(w, http.StatusBadRequest, "role must be one of: admin, member, viewer")
+		return
+	}
+
+	var m ProjectMember
+	var fullName, email sql.NullString
+	query := "SELECT id, username, full_name, email FROM users WHERE username = $1"
+	lookup := req.Username
+	if req.Email != "" {
+		query = "SELECT id, username, full_name, email FROM users WHERE email = $1"
+		lookup = req.Email
+	}
+	err := db.QueryRow(query, lookup).Scan(&m.UserID, &m.Username, &fullName, &email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusNotFound, "User not found")
+		} else {
+			RespondWithError(w, http.StatusInternalServerError, "Database error on user lookup")
+		}
+		return
+	}
+	m.FullName = fullName.String
+	m.Email = email.String
+	m.Role = req.Role
+
+	err = db.QueryRow(`
+		INSERT INTO user_project_access (user_id, project_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, project_id) DO NOTHING
+		RETURNING assigned_at
+	`, m.UserID, projectID, m.Role).Scan(&m.AssignedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusConflict, "User is already a member of this project")
+		} else {
+			requestLogger(r).Error("Failed to add project member", "project_id", projectID, "user_id", m.UserID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to add member")
+		}
+		return
+	}
+
+	RespondWithJSON(w, http.StatusCreated, m)
+}
+
+func memberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectId"]
+	memberID := vars["userId"]
+	if !isValidUUID(memberID) {
+		RespondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		if _, _, ok := authorizeProject(w, r, projectID, PermissionManageMembers); !ok {
+			return
+		}
+		updateMemberHandler(w, r, projectID, memberID)
+	case "DELETE":
+		// Any member may leave a project; removing someone else takes the
+		// manage_members permission.
+		permission := PermissionManageMembers
+		if userID, ok := sessionUserID(r); ok && userID == memberID {
+			permission = PermissionViewProject
+		}
+		if _, _, ok := authorizeProject(w, r, projectID, permission); !ok {
+			return
+		}
+		removeMemberHandler(w, r, projectID, memberID)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// projectOwnerID returns the owner of the project, locking its row when q is
+// a transaction so that ownership cannot change underneath the caller.
+func projectOwnerID(q queryRower, projectID string) (string, error) {
+	var ownerID string
+	err := q.QueryRow("SELECT owner_id FROM projects WHERE id = $1 FOR UPDATE", projectID).Scan(&ownerID)
+	return ownerID, err
+}
+
+// respondWithOwnerLookupError answers an error from projectOwnerID. The
+// project can be deleted between the permission check and the lookup.
+func respondWithOwnerLookupError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		RespondWithError(w, http.StatusNotFound, "Project not found")
+		return
+	}
+	RespondWithError(w, http.StatusInternalServerError, "Database error on project lookup")
+}
+
+// updateMemberHandler changes a member's role. The owner always stays an
+// admin, so a project can never be left without one.
+func updateMemberHandler(w http.ResponseWriter, r *http.Request, projectID, memberID string) {
+	var req UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !isValidRole(req.Role) {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload: role must be one of: admin, member, viewer")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	ownerID, err := projectOwnerID(tx, projectID)
+	if err != nil {
+		respondWithOwnerLookupError(w, err)
+		return
+	}
+	if memberID == ownerID && req.Role != RoleAdmin {
+		RespondWithError(w, http.StatusConflict, "The project owner must stay an admin; transfer ownership first")
+		return
+	}
+
+	res, err := tx.Exec("UPDATE user_project_access SET role = $1 WHERE user_id = $2 AND project_id = $3", req.Role, memberID, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"user_id": memberID, "role": req.Role})
+}
+
+// removeMemberHandler revokes a member's access. The owner cannot be removed
+// until ownership has been transferred to someone else.
+func removeMemberHandler(w http.ResponseWriter, r *http.Request, projectID, memberID string) {
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	ownerID, err := projectOwnerID(tx, projectID)
+	if err != nil {
+		respondWithOwnerLookupError(w, err)
+		return
+	}
+	if memberID == ownerID {
+		RespondWithError(w, http.StatusConflict, "The project owner cannot be removed; transfer ownership first")
+		return
+	}
+
+	res, err := tx.Exec("DELETE FROM user_project_access WHERE user_id = $1 AND project_id = $2", memberID, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+// transferOwnershipHandler makes another member the project's owner. Only the
+// current owner may do this. The new owner is made an admin; the previous
+// owner keeps their admin role and can then be demoted or removed like any
+// other member.
+func transferOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+	userID, _, ok := authorizeProject(w, r, projectID, PermissionManageMembers)
+	if !ok {
+		return
+	}
+
+	var req TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload: user_id is required")
+		return
+	}
+	if !isValidUUID(req.UserID) {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload: user_id must be a UUID")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	ownerID, err := projectOwnerID(tx, projectID)
+	if err != nil {
+		respondWithOwnerLookupError(w, err)
+		return
+	}
+	if userID != ownerID {
+		RespondWithError(w, http.StatusForbidden, "Only the project owner can transfer ownership")
+		return
+	}
+	if req.UserID == ownerID {
+		RespondWithError(w, http.StatusBadRequest, "User already owns this project")
+		return
+	}
+
+	res, err := tx.Exec("UPDATE user_project_access SET role = $1 WHERE user_id = $2 AND project_id = $3", RoleAdmin, req.UserID, projectID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "The new owner must already be a member of the project")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE projects SET owner_id = $1, updated_at = now() WHERE id = $2", req.UserID, projectID); err != nil {
+		// projects has UNIQUE (owner_id, name).
+		if isUniqueViolation(err) {
+			RespondWithError(w, http.StatusConflict, "The new owner already owns a project with this name")
+		} else {
+			requestLogger(r).Error("Failed to transfer project ownership", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to transfer ownership")
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	requestLogger(r).Info("Transferred project ownership", "project_id", projectID, "from_user_id", ownerID, "to_user_id", req.UserID)
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"owner_id": req.UserID})
+}
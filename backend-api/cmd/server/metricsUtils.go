@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMetricsMaxProjects bounds how many projects get their own label
+// value; later projects are counted under otherProjectLabel.
+const (
+	defaultMetricsMaxProjects = 50
+	otherProjectLabel         = "other"
+)
+
+var (
+	ingestionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_ingestion_requests_total",
+		Help: "Log ingestion requests by endpoint and HTTP status.",
+	}, []string{"endpoint", "status"})
+	ingestionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "backend_ingestion_request_duration_seconds",
+		Help:    "Latency of log ingestion requests by endpoint and HTTP status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+	logsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_logs_accepted_total",
+		Help: "Log entries produced to Kafka, by project.",
+	}, []string{"project"})
+	kafkaProduceErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_kafka_produce_errors_total",
+		Help: "Log entries that could not be produced to Kafka.",
+	})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_ingestion_rate_limited_total",
+		Help: "Ingestion requests refused for being over a project's rate limit or daily quota, by project and limit.",
+	}, []string{"project", "limit"})
+	schemaViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_schema_violations_total",
+		Help: "Log entries whose payload did not match their event's schema, by project and schema mode.",
+	}, []string{"project", "mode"})
+
+	projectLabels = newProjectLabeler(metricsMaxProjectsFromEnv())
+)
+
+func init() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "backend_apikey_cache_hits_total",
+		Help: "API key validations answered from the cache.",
+	}, func() float64 { return float64(apiKeyCacheStatsOrZero().Hits) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "backend_apikey_cache_misses_total",
+		Help: "API key validations that had to query CockroachDB.",
+	}, func() float64 { return float64(apiKeyCacheStatsOrZero().Misses) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "backend_apikey_cache_entries",
+		Help: "Entries currently held in the API key cache.",
+	}, func() float64 { return float64(apiKeyCacheStatsOrZero().Size) })
+}
+
+func apiKeyCacheStatsOrZero() APIKeyCacheStats {
+	if keyCache == nil {
+		return APIKeyCacheStats{}
+	}
+	return keyCache.Stats()
+}
+
+// metricsMaxProjectsFromEnv reads METRICS_MAX_PROJECTS. 0 is allowed and
+// counts every project under otherProjectLabel; unset or invalid values fall
+// back to defaultMetricsMaxProjects.
+func metricsMaxProjectsFromEnv() int {
+	if v, err := strconv.Atoi(os.Getenv("METRICS_MAX_PROJECTS")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultMetricsMaxProjects
+}
+
+// projectLabeler hands out project label values for the first max projects
+// it sees and otherProjectLabel for every project after that, which keeps the
+// number of time series bounded however many projects exist.
+type projectLabeler struct {
+	max   int
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+func newProjectLabeler(max int) *projectLabeler {
+	return &projectLabeler{max: max, known: make(map[string]bool)}
+}
+
+func (l *projectLabeler) Label(projectID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.known[projectID] {
+		return projectID
+	}
+	if len(l.known) < l.max {
+		l.known[projectID] = true
+		return projectID
+	}
+	return otherProjectLabel
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentIngestion records the count and latency of requests to an
+// ingestion endpoint. Only POST requests are counted, so the log query
+// endpoint sharing a route with single-log ingestion is not.
+func instrumentIngestion(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		status := strconv.Itoa(rec.status)
+		ingestionRequests.WithLabelValues(endpoint, status).Inc()
+		ingestionDuration.WithLabelValues(endpoint, status).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxBodyBytes = 5 << 20
+	// maxBodyBytesLimit is the largest body limit a project can be given.
+	maxBodyBytesLimit = 64 << 20
+
+	defaultMaxPayloadBytes = 256 << 10
+	// maxPayloadBytesLimit leaves room for the rest of a log within
+	// maxKafkaMessageBytes. It does not guarantee the fit on its own: that is
+	// checked on the encoded message.
+	maxPayloadBytesLimit = 900 << 10
+	// maxKafkaMessageBytes keeps an encoded log, with its key and headers,
+	// under the 1MiB that both the Kafka writer and the broker accept by
+	// default, with room for the record's own overhead.
+	maxKafkaMessageBytes = 1000 << 10
+
+	defaultMaxSearchableKeys = 32
+	maxSearchableKeysLimit   = 256
+
+	defaultMaxSearchableValueLength = 256
+	maxSearchableValueLengthLimit   = 4096
+
+	// maxEventNameLength applies whatever the project's event name pattern.
+	maxEventNameLength = 255
+	// maxSearchableKeyLength bounds the name of a searchable key.
+	maxSearchableKeyLength = 128
+)
+
+// PayloadLimits bound the size and shape of what a project ingests. They are
+// stored on the project, where 0 or an empty pattern selects the default.
+type PayloadLimits struct {
+	MaxBodyBytes             int64
+	MaxPayloadBytes          int
+	MaxSearchableKeys        int
+	MaxSearchableValueLength int
+	// EventName, when set, is a pattern every event name must match.
+	EventName *regexp.Regexp
+}
+
+// newPayloadLimits fills in the defaults for a project's stored limits. An
+// event name pattern that no longer compiles is ignored.
+func newPayloadLimits(maxBodyBytes int64, maxPayloadBytes, maxSearchableKeys, maxSearchableValueLength int, eventNamePattern string) PayloadLimits {
+	l := PayloadLimits{
+		MaxBodyBytes:             maxBodyBytes,
+		MaxPayloadBytes:          maxPayloadBytes,
+		MaxSearchableKeys:        maxSearchableKeys,
+		MaxSearchableValueLength: maxSearchableValueLength,
+	}
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if l.MaxPayloadBytes <= 0 {
+		l.MaxPayloadBytes = defaultMaxPayloadBytes
+	}
+	if l.MaxSearchableKeys <= 0 {
+		l.MaxSearchableKeys = defaultMaxSearchableKeys
+	}
+	if l.MaxSearchableValueLength <= 0 {
+		l.MaxSearchableValueLength = defaultMaxSearchableValueLength
+	}
+	if eventNamePattern != "" {
+		l.EventName, _ = regexp.Compile(eventNamePattern)
+	}
+	return l
+}
+
+// validatePayloadLimitSettings checks the limits a project is given; nil ones
+// are left as they are.
+func validatePayloadLimitSettings(maxBodyBytes *int64, maxPayloadBytes, maxSearchableKeys, maxSearchableValueLength *int, eventNamePattern *string) string {
+	if maxBodyBytes != nil && (*maxBodyBytes < 0 || *maxBodyBytes > maxBodyBytesLimit) {
+		return fmt.Sprintf("max_body_bytes must be between 0 and %d", maxBodyBytesLimit)
+	}
+	if maxPayloadBytes != nil && (*maxPayloadBytes < 0 || *maxPayloadBytes > maxPayloadBytesLimit) {
+		return fmt.Sprintf("max_payload_bytes must be between 0 and %d", maxPayloadBytesLimit)
+	}
+	if maxSearchableKeys != nil && (*maxSearchableKeys < 0 || *maxSearchableKeys > maxSearchableKeysLimit) {
+		return fmt.Sprintf("max_searchable_keys must be between 0 and %d", maxSearchableKeysLimit)
+	}
+	if maxSearchableValueLength != nil && (*maxSearchableValueLength < 0 || *maxSearchableValueLength > maxSearchableValueLengthLimit) {
+		return fmt.Sprintf("max_searchable_value_length must be between 0 and %d", maxSearchableValueLengthLimit)
+	}
+	if eventNamePattern != nil && *eventNamePattern != "" {
+		if _, err := regexp.Compile(*eventNamePattern); err != nil {
+			return "event_name_pattern is not a valid regular expression: " + err.Error()
+		}
+	}
+	return ""
+}
+
+// PayloadTooLargeError is a validation error answered with 413 rather than 400.
+type PayloadTooLargeError struct {
+	Message string
+}
+
+func (e *PayloadTooLargeError) Error() string { return e.Message }
+
+// bodyReadError returns the status and message for an error reading the
+// body: 413 if it hit the body limit, 400 otherwise.
+func bodyReadError(err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the project's limit of %d bytes", maxBytesErr.Limit)
+	}
+	return http.StatusBadRequest, "Invalid request payload: " + err.Error()
+}
+
+// validationErrorStatus is the HTTP status for a log that failed validation.
+func validationErrorStatus(err error) int {
+	var tooLarge *PayloadTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// checkPayloadLimits validates a log's event name, payload size and
+// searchable keys against the project's limits.
+func checkPayloadLimits(logPayload *LogIngestionPayload, limits PayloadLimits) error {
+	if err := checkEventName(logPayload.Name, limits); err != nil {
+		return err
+	}
+	if len(logPayload.FullPayload) > limits.MaxPayloadBytes {
+		return &PayloadTooLargeError{Message: fmt.Sprintf("full_payload is %d bytes, over the project's limit of %d bytes",
+			len(logPayload.FullPayload), limits.MaxPayloadBytes)}
+	}
+	if len(logPayload.SearchableKeys) > limits.MaxSearchableKeys {
+		return fmt.Errorf("Too many searchable keys: %d, the project allows %d", len(logPayload.SearchableKeys), limits.MaxSearchableKeys)
+	}
+	for key, value := range logPayload.SearchableKeys {
+		if key == "" {
+			return fmt.Errorf("Searchable keys must not be empty")
+		}
+		if len(key) > maxSearchableKeyLength {
+			return fmt.Errorf("Searchable key '%.32s...' exceeds %d bytes", key, maxSearchableKeyLength)
+		}
+		if n := utf8.RuneCountInString(value); n > limits.MaxSearchableValueLength {
+			return fmt.Errorf("Value of searchable key '%s' is %d characters, over the project's limit of %d", key, n, limits.MaxSearchableValueLength)
+		}
+	}
+	return nil
+}
+
+func checkEventName(name string, limits PayloadLimits) error {
+	if len(name) > maxEventNameLength {
+		return fmt.Errorf("Event name exceeds %d bytes", maxEventNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("Event name must not contain control characters")
+		}
+	}
+	if limits.EventName != nil && !limits.EventName.MatchString(name) {
+		return fmt.Errorf("Event name '%s' does not match the project's pattern %s", name, limits.EventName.String())
+	}
+	return nil
+}
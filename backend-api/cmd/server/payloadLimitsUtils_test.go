@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCheckPayloadLimits(t *testing.T) {
+	limits := newPayloadLimits(0, 16, 2, 5, "")
+	patterned := newPayloadLimits(0, 0, 0, 0, `^[a-z_]+$`)
+	tests := []struct {
+		name       string
+		limits     PayloadLimits
+		payload    LogIngestionPayload
+		wantErr    bool
+		wantStatus int
+	}{
+		{
+			name:    "within limits",
+			limits:  limits,
+			payload: LogIngestionPayload{Name: "login", FullPayload: json.RawMessage(`{"a":1}`), SearchableKeys: map[string]string{"k": "héllo"}},
+		},
+		{
+			name:       "payload over the limit",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "login", FullPayload: json.RawMessage(`{"a":"0123456789"}`)},
+			wantErr:    true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too many searchable keys",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "login", SearchableKeys: map[string]string{"a": "1", "b": "2", "c": "3"}},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty searchable key",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "login", SearchableKeys: map[string]string{"": "1"}},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "searchable key name too long",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "login", SearchableKeys: map[string]string{strings.Repeat("k", maxSearchableKeyLength+1): "1"}},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "searchable value over the limit in characters",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "login", SearchableKeys: map[string]string{"k": "héllo!"}},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "event name too long",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: strings.Repeat("e", maxEventNameLength+1)},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "event name with a control character",
+			limits:     limits,
+			payload:    LogIngestionPayload{Name: "log\nin"},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:    "event name matching the pattern",
+			limits:  patterned,
+			payload: LogIngestionPayload{Name: "user_login"},
+		},
+		{
+			name:       "event name not matching the pattern",
+			limits:     patterned,
+			payload:    LogIngestionPayload{Name: "UserLogin"},
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPayloadLimits(&tt.payload, tt.limits)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("checkPayloadLimits() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("checkPayloadLimits() = nil, want an error")
+			}
+			if status := validationErrorStatus(err); status != tt.wantStatus {
+				t.Errorf("validationErrorStatus() = %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestBuildKafkaMessageSize(t *testing.T) {
+	logID := gocql.UUIDFromTime(time.Now())
+	tests := []struct {
+		name        string
+		payloadSize int
+		wantErr     bool
+	}{
+		{"fits", maxPayloadBytesLimit, false},
+		{"over the Kafka message limit", maxKafkaMessageBytes, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A string of '<' would grow sixfold if HTML were escaped.
+			payload := json.RawMessage(`"` + strings.Repeat("<", tt.payloadSize-2) + `"`)
+			logPayload := &LogIngestionPayload{Name: "login", Timestamp: time.Now(), FullPayload: payload}
+			msg, err := buildKafkaMessage("project", logID, "request", logPayload)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("buildKafkaMessage() error = %v", err)
+				}
+				if len(msg.Value) > maxKafkaMessageBytes {
+					t.Errorf("message is %d bytes, over %d", len(msg.Value), maxKafkaMessageBytes)
+				}
+				return
+			}
+			if status := validationErrorStatus(err); status != http.StatusRequestEntityTooLarge {
+				t.Errorf("buildKafkaMessage() error = %v, want a 413", err)
+			}
+		})
+	}
+}
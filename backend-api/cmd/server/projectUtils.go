@@ -5,18 +5,68 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"log/slog"
 	"net/http"
-	"log"
+	"strings"
+
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
 )
 
-
 type CreateProjectRequest struct {
-	Name           string   `json:"name"`
-	SearchableKeys []string `json:"searchable_keys"`
-	LogTTLSeconds  int      `json:"log_ttl_seconds"`
-	Description    string   `json:"description"`
+	Name                     string   `json:"name"`
+	SearchableKeys           []string `json:"searchable_keys"`
+	SearchableKeysPolicy     string   `json:"searchable_keys_policy"`
+	LogTTLSeconds            int      `json:"log_ttl_seconds"`
+	Description              string   `json:"description"`
+	RateLimitPerSecond       int      `json:"rate_limit_per_second"`
+	RateLimitBurst           int      `json:"rate_limit_burst"`
+	DailyLogQuota            int64    `json:"daily_log_quota"`
+	MaxBodyBytes             int64    `json:"max_body_bytes"`
+	MaxPayloadBytes          int      `json:"max_payload_bytes"`
+	MaxSearchableKeys        int      `json:"max_searchable_keys"`
+	MaxSearchableValueLength int      `json:"max_searchable_value_length"`
+	EventNamePattern         string   `json:"event_name_pattern"`
+}
+
+// UpdateProjectRequest holds the fields to change; omitted fields are kept.
+type UpdateProjectRequest struct {
+	Name                     *string   `json:"name"`
+	SearchableKeys           *[]string `json:"searchable_keys"`
+	SearchableKeysPolicy     *string   `json:"searchable_keys_policy"`
+	LogTTLSeconds            *int      `json:"log_ttl_seconds"`
+	Description              *string   `json:"description"`
+	RateLimitPerSecond       *int      `json:"rate_limit_per_second"`
+	RateLimitBurst           *int      `json:"rate_limit_burst"`
+	DailyLogQuota            *int64    `json:"daily_log_quota"`
+	MaxBodyBytes             *int64    `json:"max_body_bytes"`
+	MaxPayloadBytes          *int      `json:"max_payload_bytes"`
+	MaxSearchableKeys        *int      `json:"max_searchable_keys"`
+	MaxSearchableValueLength *int      `json:"max_searchable_value_length"`
+	EventNamePattern         *string   `json:"event_name_pattern"`
+}
+
+const (
+	SearchableKeysPolicyReject = "reject"
+	SearchableKeysPolicyDrop   = "drop"
+	SearchableKeysPolicyAllow  = "allow"
+)
+
+// validateIngestionLimits checks the limits a project is given; nil ones are
+// left as they are.
+func validateIngestionLimits(rate, burst *int, quota *int64) string {
+	if (rate != nil && *rate < 0) || (burst != nil && *burst < 0) || (quota != nil && *quota < 0) {
+		return "rate_limit_per_second, rate_limit_burst and daily_log_quota must not be negative"
+	}
+	return ""
+}
+
+func isValidSearchableKeysPolicy(policy string) bool {
+	switch policy {
+	case SearchableKeysPolicyReject, SearchableKeysPolicyDrop, SearchableKeysPolicyAllow:
+		return true
+	}
+	return false
 }
 
 func projectsHandler(w http.ResponseWriter, r *http.Request) {
@@ -39,10 +89,12 @@ func projectsHandler(w http.ResponseWriter, r *http.Request) {
 
 func getProjectsHandler(w http.ResponseWriter, userID string) {
 	rows, err := db.Query(`
-		SELECT p.id, p.name, p.searchable_keys, p.log_ttl_seconds, p.owner_id, p.description
+		SELECT p.id, p.name, p.searchable_keys, p.searchable_keys_policy, p.log_ttl_seconds, p.owner_id, p.description, upa.role,
+		       p.rate_limit_per_second, p.rate_limit_burst, p.daily_log_quota,
+		       p.max_body_bytes, p.max_payload_bytes, p.max_searchable_keys, p.max_searchable_value_length, p.event_name_pattern
 		FROM projects p
 		JOIN user_project_access upa ON p.id = upa.project_id
-		WHERE upa.user_id = $1
+		WHERE upa.user_id = $1 AND p.is_active IS NOT FALSE
 	`, userID)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Database error")
@@ -53,9 +105,11 @@ func getProjectsHandler(w http.ResponseWriter, userID string) {
 	projects := []Project{}
 	for rows.Next() {
 		var p Project
-		if err := rows.Scan(&p.ID, &p.Name, pq.Array(&p.SearchableKeys), &p.LogTTLSeconds, &p.OwnerID, &p.Description); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, pq.Array(&p.SearchableKeys), &p.SearchableKeysPolicy, &p.LogTTLSeconds, &p.OwnerID, &p.Description, &p.Role,
+			&p.RateLimitPerSecond, &p.RateLimitBurst, &p.DailyLogQuota,
+			&p.MaxBodyBytes, &p.MaxPayloadBytes, &p.MaxSearchableKeys, &p.MaxSearchableValueLength, &p.EventNamePattern); err != nil {
 			// Log the detailed error for debugging
-			log.Printf("Scan error: %v", err)
+			slog.Error("Failed to scan project", "user_id", userID, "error", err)
 			RespondWithError(w, http.StatusInternalServerError, "Failed to scan project")
 			return
 		}
@@ -71,10 +125,19 @@ func createProjectHandler(w http.ResponseWriter, r *http.Request, userID string)
 		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-
-	apiKey, err := generateAPIKey()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Failed to generate API key")
+	if req.SearchableKeysPolicy == "" {
+		req.SearchableKeysPolicy = SearchableKeysPolicyAllow
+	}
+	if !isValidSearchableKeysPolicy(req.SearchableKeysPolicy) {
+		RespondWithError(w, http.StatusBadRequest, "searchable_keys_policy must be one of: reject, drop, allow")
+		return
+	}
+	if msg := validateIngestionLimits(&req.RateLimitPerSecond, &req.RateLimitBurst, &req.DailyLogQuota); msg != "" {
+		RespondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if msg := validatePayloadLimitSettings(&req.MaxBodyBytes, &req.MaxPayloadBytes, &req.MaxSearchableKeys, &req.MaxSearchableValueLength, &req.EventNamePattern); msg != "" {
+		RespondWithError(w, http.StatusBadRequest, msg)
 		return
 	}
 
@@ -86,14 +149,30 @@ func createProjectHandler(w http.ResponseWriter, r *http.Request, userID string)
 	}
 	defer tx.Rollback()
 
-	err = tx.QueryRow("INSERT INTO projects (name, api_key, searchable_keys, log_ttl_seconds, owner_id, description) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
-		req.Name, apiKey, pq.Array(req.SearchableKeys), req.LogTTLSeconds, userID, req.Description).Scan(&projectID)
+	err = tx.QueryRow(`
+		INSERT INTO projects (name, searchable_keys, searchable_keys_policy, log_ttl_seconds, owner_id, description,
+		                      rate_limit_per_second, rate_limit_burst, daily_log_quota,
+		                      max_body_bytes, max_payload_bytes, max_searchable_keys, max_searchable_value_length, event_name_pattern)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id`,
+		req.Name, pq.Array(req.SearchableKeys), req.SearchableKeysPolicy, req.LogTTLSeconds, userID, req.Description,
+		req.RateLimitPerSecond, req.RateLimitBurst, req.DailyLogQuota,
+		req.MaxBodyBytes, req.MaxPayloadBytes, req.MaxSearchableKeys, req.MaxSearchableValueLength, req.EventNamePattern).Scan(&projectID)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Failed to create project")
+		if isUniqueViolation(err) {
+			RespondWithError(w, http.StatusConflict, "You already own a project with this name")
+		} else {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create project")
+		}
+		return
+	}
+
+	apiKey, err := insertAPIKey(tx, projectID, "default", []string{APIKeyScopeIngest, APIKeyScopeRead}, userID, nil)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to create API key")
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO user_project_access (user_id, project_id, role) VALUES ($1, $2, 'admin')", userID, projectID)
+	_, err = tx.Exec("INSERT INTO user_project_access (user_id, project_id, role) VALUES ($1, $2, $3)", userID, projectID, RoleAdmin)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to grant project access")
 		return
@@ -104,7 +183,10 @@ func createProjectHandler(w http.ResponseWriter, r *http.Request, userID string)
 		return
 	}
 
-	RespondWithJSON(w, http.StatusCreated, Project{ID: projectID, Name: req.Name, APIKey: apiKey, SearchableKeys: req.SearchableKeys, LogTTLSeconds: req.LogTTLSeconds, OwnerID: userID, Description: req.Description})
+	RespondWithJSON(w, http.StatusCreated, Project{ID: projectID, Name: req.Name, APIKey: apiKey.APIKey, SearchableKeys: req.SearchableKeys, SearchableKeysPolicy: req.SearchableKeysPolicy, LogTTLSeconds: req.LogTTLSeconds, OwnerID: userID, Description: req.Description, Role: RoleAdmin,
+		RateLimitPerSecond: req.RateLimitPerSecond, RateLimitBurst: req.RateLimitBurst, DailyLogQuota: req.DailyLogQuota,
+		MaxBodyBytes: req.MaxBodyBytes, MaxPayloadBytes: req.MaxPayloadBytes, MaxSearchableKeys: req.MaxSearchableKeys,
+		MaxSearchableValueLength: req.MaxSearchableValueLength, EventNamePattern: req.EventNamePattern})
 }
 
 func generateAPIKey() (string, error) {
@@ -115,41 +197,191 @@ func generateAPIKey() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// getProjectAPIKeyHandler describes the project's newest active ingestion key.
+// Only its prefix is known; the full key is shown once, when it is created.
 func getProjectAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "logsys-session")
-	userID, ok := session.Values["user_id"].(string)
-	if !ok {
-		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
 	vars := mux.Vars(r)
 	projectID := vars["projectId"]
 
-	var apiKey string
-	// Check if user has access to the project
-	var accessCheck int
-	err := db.QueryRow("SELECT 1 FROM user_project_access WHERE user_id = $1 AND project_id = $2", userID, projectID).Scan(&accessCheck)
+	if _, _, ok := authorizeProject(w, r, projectID, PermissionManageKeys); !ok {
+		return
+	}
+
+	var keyID, keyPrefix string
+	err := db.QueryRow(`
+		SELECT id, key_prefix FROM project_api_keys
+		WHERE project_id = $1 AND 'ingest' = ANY(scopes)
+		  AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, projectID).Scan(&keyID, &keyPrefix)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusForbidden, "You do not have access to this project")
+			RespondWithError(w, http.StatusNotFound, "Project has no active API key")
 		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Database error on access check")
+			RespondWithError(w, http.StatusInternalServerError, "Database error on API key fetch")
 		}
 		return
 	}
 
-	// If user has access, get the API key
-	err = db.QueryRow("SELECT api_key FROM projects WHERE id = $1", projectID).Scan(&apiKey)
+	RespondWithJSON(w, http.StatusOK, map[string]string{"id": keyID, "key_prefix": keyPrefix})
+}
+
+func projectHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+
+	switch r.Method {
+	case "PATCH":
+		updateProjectHandler(w, r, projectID)
+	case "DELETE":
+		deleteProjectHandler(w, r, projectID)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// updateProjectHandler edits a project's name, searchable keys, policy, TTL,
+// description, ingestion limits and payload limits. A new TTL applies to logs stored from
+// then on.
+func updateProjectHandler(w http.ResponseWriter, r *http.Request, projectID string) {
+	_, role, ok := authorizeProject(w, r, projectID, PermissionManageProject)
+	if !ok {
+		return
+	}
+
+	var req UpdateProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		RespondWithError(w, http.StatusBadRequest, "name must not be empty")
+		return
+	}
+	if req.SearchableKeysPolicy != nil && !isValidSearchableKeysPolicy(*req.SearchableKeysPolicy) {
+		RespondWithError(w, http.StatusBadRequest, "searchable_keys_policy must be one of: reject, drop, allow")
+		return
+	}
+	if req.LogTTLSeconds != nil && *req.LogTTLSeconds < 0 {
+		RespondWithError(w, http.StatusBadRequest, "log_ttl_seconds must not be negative")
+		return
+	}
+	if msg := validateIngestionLimits(req.RateLimitPerSecond, req.RateLimitBurst, req.DailyLogQuota); msg != "" {
+		RespondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if msg := validatePayloadLimitSettings(req.MaxBodyBytes, req.MaxPayloadBytes, req.MaxSearchableKeys, req.MaxSearchableValueLength, req.EventNamePattern); msg != "" {
+		RespondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+	var searchableKeys interface{}
+	if req.SearchableKeys != nil {
+		keys := *req.SearchableKeys
+		if keys == nil {
+			keys = []string{}
+		}
+		searchableKeys = pq.Array(keys)
+	}
+
+	p := Project{Role: role}
+	err := db.QueryRow(`
+		UPDATE projects SET
+			name = COALESCE($1, name),
+			searchable_keys = COALESCE($2, searchable_keys),
+			searchable_keys_policy = COALESCE($3, searchable_keys_policy),
+			log_ttl_seconds = COALESCE($4, log_ttl_seconds),
+			description = COALESCE($5, description),
+			rate_limit_per_second = COALESCE($6, rate_limit_per_second),
+			rate_limit_burst = COALESCE($7, rate_limit_burst),
+			daily_log_quota = COALESCE($8, daily_log_quota),
+			max_body_bytes = COALESCE($9, max_body_bytes),
+			max_payload_bytes = COALESCE($10, max_payload_bytes),
+			max_searchable_keys = COALESCE($11, max_searchable_keys),
+			max_searchable_value_length = COALESCE($12, max_searchable_value_length),
+			event_name_pattern = COALESCE($13, event_name_pattern),
+			updated_at = now()
+		WHERE id = $14
+		RETURNING id, name, searchable_keys, searchable_keys_policy, log_ttl_seconds, owner_id, description,
+		          rate_limit_per_second, rate_limit_burst, daily_log_quota,
+		          max_body_bytes, max_payload_bytes, max_searchable_keys, max_searchable_value_length, event_name_pattern
+	`, req.Name, searchableKeys, req.SearchableKeysPolicy, req.LogTTLSeconds, req.Description,
+		req.RateLimitPerSecond, req.RateLimitBurst, req.DailyLogQuota,
+		req.MaxBodyBytes, req.MaxPayloadBytes, req.MaxSearchableKeys, req.MaxSearchableValueLength, req.EventNamePattern, projectID).Scan(
+		&p.ID, &p.Name, pq.Array(&p.SearchableKeys), &p.SearchableKeysPolicy, &p.LogTTLSeconds, &p.OwnerID, &p.Description,
+		&p.RateLimitPerSecond, &p.RateLimitBurst, &p.DailyLogQuota,
+		&p.MaxBodyBytes, &p.MaxPayloadBytes, &p.MaxSearchableKeys, &p.MaxSearchableValueLength, &p.EventNamePattern)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// This should not happen if the access check passed, but handle it just in case
-			RespondWithError(w, http.StatusNotFound, "Project not found")
+		if isUniqueViolation(err) {
+			RespondWithError(w, http.StatusConflict, "The project owner already has a project with this name")
 		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Database error on API key fetch")
+			requestLogger(r).Error("Failed to update project", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to update project")
 		}
 		return
 	}
+	// Cached API keys carry the project's searchable keys, policy and limits.
+	keyCache.InvalidateProject(projectID)
 
-	RespondWithJSON(w, http.StatusOK, map[string]string{"api_key": apiKey})
-}
\ No newline at end of file
+	RespondWithJSON(w, http.StatusOK, p)
+}
+
+// deleteProjectHandler deactivates the project, revokes its API keys and
+// queues a job that purges its logs and then deletes it. Only the owner can
+// delete a project. The response is the job, which can be polled at
+// /api/jobs/{jobId}.
+func deleteProjectHandler(w http.ResponseWriter, r *http.Request, projectID string) {
+	userID, _, ok := authorizeProject(w, r, projectID, PermissionManageProject)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	ownerID, err := projectOwnerID(tx, projectID)
+	if err != nil {
+		respondWithOwnerLookupError(w, err)
+		return
+	}
+	if userID != ownerID {
+		RespondWithError(w, http.StatusForbidden, "Only the project owner can delete the project")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE projects SET is_active = false, updated_at = now() WHERE id = $1", projectID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to deactivate project")
+		return
+	}
+	if _, err := tx.Exec("UPDATE project_api_keys SET revoked_at = now() WHERE project_id = $1 AND revoked_at IS NULL", projectID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to revoke API keys")
+		return
+	}
+
+	job := ProjectJob{ProjectID: projectID, Kind: JobKindDeleteProject}
+	err = tx.QueryRow(`
+		INSERT INTO project_jobs (project_id, kind, created_by, run_after)
+		VALUES ($1, $2, $3, now() + $4 * INTERVAL '1 second')
+		RETURNING id, status, attempts, run_after, created_at
+	`, projectID, JobKindDeleteProject, userID, int(purgeDelayFromEnv().Seconds())).Scan(
+		&job.ID, &job.Status, &job.Attempts, &job.RunAfter, &job.CreatedAt)
+	if err != nil {
+		requestLogger(r).Error("Failed to queue project deletion", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to queue project deletion")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	keyCache.InvalidateProject(projectID)
+	jobs.Notify()
+	requestLogger(r).Info("Queued project deletion", "project_id", projectID, "job_id", job.ID, "run_after", job.RunAfter)
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	RespondWithJSON(w, http.StatusAccepted, job)
+}
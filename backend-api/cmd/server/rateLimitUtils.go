@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// LimitRate and LimitQuota name the limit a request ran into.
+	LimitRate  = "rate"
+	LimitQuota = "quota"
+
+	// rateLeaseFraction sizes a lease of rate-limited tokens as a tenth of a
+	// second's worth, so a replica never holds much of the shared budget.
+	rateLeaseFraction = 10
+	// quotaLeaseFraction sizes a lease of a quota-limited project as a
+	// hundredth of its daily quota.
+	quotaLeaseFraction = 100
+	// usageFlushInterval is how often accepted log counts are added to
+	// project_usage.
+	usageFlushInterval = 5 * time.Second
+	// maxLeaseAttempts bounds the retries of a lease transaction that lost a
+	// conflict with another replica.
+	maxLeaseAttempts = 3
+
+	defaultUsageDays = 7
+	maxUsageDays     = 90
+)
+
+// IngestionLimits are a project's ingestion limits. Zero means unlimited.
+type IngestionLimits struct {
+	RatePerSecond int
+	// Burst is the size of the token bucket; 0 means RatePerSecond.
+	Burst      int
+	DailyQuota int64
+}
+
+func (l IngestionLimits) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.RatePerSecond
+}
+
+// LimitError is returned when a request is over one of its project's limits.
+type LimitError struct {
+	Limit string
+	// RetryAfter is when the request may succeed; 0 if it never will.
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *LimitError) Error() string { return e.Message }
+
+// ingestionLimiter enforces the rate limits and daily quotas of projects
+// across all backend-api replicas. Each project has a token bucket and a
+// daily count of reserved logs in CockroachDB. A replica leases permits from
+// both in one transaction, a small slice at a time, and hands them out
+// locally until they run out. Leased permits count against the quota, so a
+// project can be refused up to one lease per replica before it has really
+// sent its quota.
+type ingestionLimiter struct {
+	mu       sync.Mutex
+	projects map[string]*projectPermits
+}
+
+// projectPermits are the permits a replica holds for one project and day.
+type projectPermits struct {
+	mu      sync.Mutex
+	day     string
+	permits int64
+}
+
+var limiter = &ingestionLimiter{projects: make(map[string]*projectPermits)}
+
+func (l *ingestionLimiter) permitsFor(projectID string) *projectPermits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.projects[projectID]
+	if !ok {
+		p = &projectPermits{}
+		l.projects[projectID] = p
+	}
+	return p
+}
+
+// Acquire takes n permits for the project and returns the day they count
+// against, or "" if the project is unlimited. It returns a *LimitError when
+// the project is over a limit. Other errors mean the shared state could not
+// be reached; callers let the request through rather than stop ingestion.
+func (l *ingestionLimiter) Acquire(ctx context.Context, projectID string, limits IngestionLimits, n int) (string, error) {
+	if limits.RatePerSecond <= 0 && limits.DailyQuota <= 0 {
+		return "", nil
+	}
+	if err := checkRequestFits(limits, n); err != nil {
+		return "", err
+	}
+
+	p := l.permitsFor(projectID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	if p.day != day {
+		p.day, p.permits = day, 0
+	}
+	if p.permits >= int64(n) {
+		p.permits -= int64(n)
+		return day, nil
+	}
+
+	need := int64(n) - p.permits
+	granted, err := leasePermits(ctx, projectID, limits, day, need, leaseSize(limits, need))
+	if err != nil {
+		return "", err
+	}
+	p.permits += granted - int64(n)
+	return day, nil
+}
+
+// Release gives back n permits taken on day for logs that were not accepted
+// after all, so they can be used by later requests. Permits of a past day are
+// dropped along with that day's quota.
+func (l *ingestionLimiter) Release(projectID, day string, n int) {
+	p := l.permitsFor(projectID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.day == day {
+		p.permits += int64(n)
+	}
+}
+
+// checkRequestFits returns a *LimitError without a RetryAfter for a request
+// of n logs that no amount of waiting would let through.
+func checkRequestFits(limits IngestionLimits, n int) error {
+	if limits.RatePerSecond > 0 && n > limits.burst() {
+		return &LimitError{
+			Limit:   LimitRate,
+			Message: fmt.Sprintf("Request of %d logs exceeds the project's burst of %d logs", n, limits.burst()),
+		}
+	}
+	if limits.DailyQuota > 0 && int64(n) > limits.DailyQuota {
+		return &LimitError{
+			Limit:   LimitQuota,
+			Message: fmt.Sprintf("Request of %d logs exceeds the project's daily quota of %d logs", n, limits.DailyQuota),
+		}
+	}
+	return nil
+}
+
+// leaseSize is how many permits to ask for when need are missing.
+func leaseSize(limits IngestionLimits, need int64) int64 {
+	size := int64(math.MaxInt64)
+	if limits.RatePerSecond > 0 {
+		size = int64(max(1, limits.RatePerSecond/rateLeaseFraction))
+	}
+	if limits.DailyQuota > 0 {
+		size = min(size, max(1, limits.DailyQuota/quotaLeaseFraction))
+	}
+	return max(size, need)
+}
+
+// leasePermits takes between need and want permits from the project's shared
+// bucket and today's quota, retrying transactions that conflicted with
+// another replica.
+func leasePermits(ctx context.Context, projectID string, limits IngestionLimits, day string, need, want int64) (int64, error) {
+	var granted int64
+	var err error
+	for attempt := 1; attempt <= maxLeaseAttempts; attempt++ {
+		granted, err = leasePermitsOnce(ctx, projectID, limits, day, need, want)
+		if !isRetryableTxError(err) {
+			break
+		}
+	}
+	return granted, err
+}
+
+func leasePermitsOnce(ctx context.Context, projectID string, limits IngestionLimits, day string, need, want int64) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT now()`).Scan(&now); err != nil {
+		return 0, err
+	}
+
+	available := int64(math.MaxInt64)
+	var tokens float64
+	if limits.RatePerSecond > 0 {
+		var updatedAt time.Time
+		err := tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM project_rate_buckets WHERE project_id = $1 FOR UPDATE`,
+			projectID).Scan(&tokens, &updatedAt)
+		switch {
+		case err == sql.ErrNoRows:
+			tokens = float64(limits.burst())
+		case err != nil:
+			return 0, err
+		default:
+			tokens = refillTokens(tokens, now.Sub(updatedAt), limits)
+		}
+		available = int64(tokens)
+	}
+
+	var used int64
+	if limits.DailyQuota > 0 {
+		err := tx.QueryRowContext(ctx, `SELECT logs_reserved FROM project_usage WHERE project_id = $1 AND day = $2 FOR UPDATE`,
+			projectID, day).Scan(&used)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		available = min(available, limits.DailyQuota-used)
+	}
+
+	if available < need {
+		if limits.DailyQuota > 0 && limits.DailyQuota-used < need {
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			return 0, &LimitError{
+				Limit:      LimitQuota,
+				RetryAfter: midnight.Sub(now),
+				Message:    fmt.Sprintf("Daily quota of %d logs exceeded", limits.DailyQuota),
+			}
+		}
+		wait := time.Duration((float64(need) - tokens) / float64(limits.RatePerSecond) * float64(time.Second))
+		return 0, &LimitError{
+			Limit:      LimitRate,
+			RetryAfter: max(wait, time.Millisecond),
+			Message:    fmt.Sprintf("Rate limit of %d logs per second exceeded", limits.RatePerSecond),
+		}
+	}
+
+	granted := min(available, want)
+	if limits.RatePerSecond > 0 {
+		_, err := tx.ExecContext(ctx, `UPSERT INTO project_rate_buckets (project_id, tokens, updated_at) VALUES ($1, $2, $3)`,
+			projectID, tokens-float64(granted), now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if limits.DailyQuota > 0 {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO project_usage (project_id, day, logs_reserved, updated_at) VALUES ($1, $2, $3, now())
+			ON CONFLICT (project_id, day) DO UPDATE SET logs_reserved = project_usage.logs_reserved + $3, updated_at = now()
+		`, projectID, day, granted)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return granted, nil
+}
+
+// refillTokens adds the tokens earned over elapsed to a bucket, up to its
+// burst.
+func refillTokens(tokens float64, elapsed time.Duration, limits IngestionLimits) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * float64(limits.RatePerSecond)
+	}
+	return min(tokens, float64(limits.burst()))
+}
+
+// isRetryableTxError reports whether err is a serialization failure that
+// CockroachDB expects the client to retry.
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
+
+// isForeignKeyViolation reports whether err is a foreign key violation.
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+type usageKey struct {
+	projectID string
+	day       string
+}
+
+// usageRecorder counts the logs each project had accepted and adds the counts
+// to project_usage every usageFlushInterval, so counting costs ingestion no
+// database round trip.
+type usageRecorder struct {
+	mu     sync.Mutex
+	counts map[usageKey]int64
+	wg     sync.WaitGroup
+}
+
+var usageCounter = &usageRecorder{counts: make(map[usageKey]int64)}
+
+// Record counts n logs accepted for the project today.
+func (u *usageRecorder) Record(projectID string, n int) {
+	key := usageKey{projectID: projectID, day: time.Now().UTC().Format(time.DateOnly)}
+	u.mu.Lock()
+	u.counts[key] += int64(n)
+	u.mu.Unlock()
+}
+
+// Start flushes the counts until ctx is cancelled, and once more after that.
+func (u *usageRecorder) Start(ctx context.Context) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), usageFlushInterval)
+				u.flush(flushCtx)
+				cancel()
+				return
+			case <-ticker.C:
+				u.flush(ctx)
+			}
+		}
+	}()
+}
+
+// Wait blocks until the final flush is done.
+func (u *usageRecorder) Wait() {
+	u.wg.Wait()
+}
+
+// flush writes the pending counts. Counts that fail to be written are kept for
+// the next flush, except those of projects that no longer exist.
+func (u *usageRecorder) flush(ctx context.Context) {
+	u.mu.Lock()
+	counts := u.counts
+	u.counts = make(map[usageKey]int64)
+	u.mu.Unlock()
+
+	for key, n := range counts {
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO project_usage (project_id, day, logs_accepted, updated_at) VALUES ($1, $2, $3, now())
+			ON CONFLICT (project_id, day) DO UPDATE SET logs_accepted = project_usage.logs_accepted + $3, updated_at = now()
+		`, key.projectID, key.day, n)
+		if err == nil || isForeignKeyViolation(err) {
+			continue
+		}
+		slog.Warn("Failed to record project usage", "project_id", key.projectID, "day", key.day, "error", err)
+		u.mu.Lock()
+		u.counts[key] += n
+		u.mu.Unlock()
+	}
+}
+
+// ingestionGrant is the permits enforceIngestionLimits took for a request.
+// A nil grant took none.
+type ingestionGrant struct {
+	projectID string
+	day       string
+}
+
+// Release gives back the permits of n logs that failed to be produced, so
+// they do not count against the project's quota.
+func (g *ingestionGrant) Release(n int) {
+	if g == nil || n <= 0 {
+		return
+	}
+	limiter.Release(g.projectID, g.day, n)
+}
+
+// enforceIngestionLimits takes n permits for the project and, when it is
+// over a limit, writes a 429 (or a 413 for a request that can never fit)
+// and returns false. The returned grant releases permits of logs that end up
+// not being accepted.
+func enforceIngestionLimits(w http.ResponseWriter, r *http.Request, project *IngestionProject, n int) (*ingestionGrant, bool) {
+	day, err := limiter.Acquire(r.Context(), project.ID, project.Limits, n)
+	if err == nil {
+		if day == "" {
+			return nil, true
+		}
+		return &ingestionGrant{projectID: project.ID, day: day}, true
+	}
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		requestLogger(r).Warn("Failed to check ingestion limits, letting the request through", "project_id", project.ID, "error", err)
+		return nil, true
+	}
+
+	rateLimited.WithLabelValues(projectLabels.Label(project.ID), limitErr.Limit).Inc()
+	if limitErr.RetryAfter <= 0 {
+		RespondWithError(w, http.StatusRequestEntityTooLarge, limitErr.Message)
+		return nil, false
+	}
+	seconds := int(math.Ceil(limitErr.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds)))
+	RespondWithJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":               limitErr.Message,
+		"limit":               limitErr.Limit,
+		"retry_after_seconds": max(1, seconds),
+	})
+	return nil, false
+}
+
+type DailyUsage struct {
+	Day          string `json:"day"`
+	LogsAccepted int64  `json:"logs_accepted"`
+}
+
+type ProjectUsage struct {
+	RateLimitPerSecond int   `json:"rate_limit_per_second"`
+	RateLimitBurst     int   `json:"rate_limit_burst"`
+	DailyLogQuota      int64 `json:"daily_log_quota"`
+	// TokensAvailable is what is left in the shared token bucket, not
+	// counting tokens already leased by replicas. Only set when the project
+	// is rate limited.
+	TokensAvailable *float64 `json:"tokens_available,omitempty"`
+	// QuotaUsed is how much of today's quota replicas have leased, which
+	// can be ahead of Today.LogsAccepted. Only set when the project has a
+	// quota, as is QuotaRemaining.
+	QuotaUsed      *int64       `json:"quota_used,omitempty"`
+	QuotaRemaining *int64       `json:"quota_remaining,omitempty"`
+	Today          DailyUsage   `json:"today"`
+	Days           []DailyUsage `json:"days"`
+}
+
+// usageHandler reports a project's limits, its usage today and over the
+// last `days` days (default 7). Accepted counts lag by up to
+// usageFlushInterval.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+	if _, _, ok := authorizeProject(w, r, projectID, PermissionViewProject); !ok {
+		return
+	}
+
+	days := defaultUsageDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUsageDays {
+			RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxUsageDays))
+			return
+		}
+		days = n
+	}
+
+	var usage ProjectUsage
+	err := db.QueryRow("SELECT rate_limit_per_second, rate_limit_burst, daily_log_quota FROM projects WHERE id = $1", projectID).Scan(
+		&usage.RateLimitPerSecond, &usage.RateLimitBurst, &usage.DailyLogQuota)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error on project fetch")
+		return
+	}
+	limits := IngestionLimits{RatePerSecond: usage.RateLimitPerSecond, Burst: usage.RateLimitBurst, DailyQuota: usage.DailyLogQuota}
+
+	if limits.RatePerSecond > 0 {
+		var tokens float64
+		var elapsed float64
+		err := db.QueryRow("SELECT tokens, extract(epoch FROM now() - updated_at) FROM project_rate_buckets WHERE project_id = $1", projectID).Scan(&tokens, &elapsed)
+		switch {
+		case err == sql.ErrNoRows:
+			tokens = float64(limits.burst())
+		case err != nil:
+			RespondWithError(w, http.StatusInternalServerError, "Database error on rate bucket fetch")
+			return
+		default:
+			tokens = refillTokens(tokens, time.Duration(elapsed*float64(time.Second)), limits)
+		}
+		usage.TokensAvailable = &tokens
+	}
+
+	today := time.Now().UTC()
+	usage.Today = DailyUsage{Day: today.Format(time.DateOnly)}
+	var quotaUsed int64
+	rows, err := db.Query(`
+		SELECT day::STRING, logs_accepted, logs_reserved FROM project_usage
+		WHERE project_id = $1 AND day > $2::DATE - $3::INT
+		ORDER BY day DESC
+	`, projectID, usage.Today.Day, days)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error on usage fetch")
+		return
+	}
+	defer rows.Close()
+	usage.Days = []DailyUsage{}
+	for rows.Next() {
+		var d DailyUsage
+		var reserved int64
+		if err := rows.Scan(&d.Day, &d.LogsAccepted, &reserved); err != nil {
+			requestLogger(r).Error("Failed to scan project usage", "project_id", projectID, "error", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to scan project usage")
+			return
+		}
+		if d.Day == usage.Today.Day {
+			usage.Today = d
+			quotaUsed = reserved
+		}
+		usage.Days = append(usage.Days, d)
+	}
+	if limits.DailyQuota > 0 {
+		remaining := max(0, limits.DailyQuota-quotaUsed)
+		usage.QuotaUsed = &quotaUsed
+		usage.QuotaRemaining = &remaining
+	}
+
+	RespondWithJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefillTokens(t *testing.T) {
+	limits := IngestionLimits{RatePerSecond: 10, Burst: 50}
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		limits  IngestionLimits
+		want    float64
+	}{
+		{"no time passed", 5, 0, limits, 5},
+		{"clock went backwards", 5, -time.Second, limits, 5},
+		{"partial second", 0, 500 * time.Millisecond, limits, 5},
+		{"several seconds", 12, 3 * time.Second, limits, 42},
+		{"capped at burst", 45, time.Minute, limits, 50},
+		{"burst defaults to rate", 0, time.Hour, IngestionLimits{RatePerSecond: 10}, 10},
+		{"over burst is cut back", 80, 0, limits, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refillTokens(tt.tokens, tt.elapsed, tt.limits); got != tt.want {
+				t.Errorf("refillTokens(%v, %v) = %v, want %v", tt.tokens, tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits IngestionLimits
+		need   int64
+		want   int64
+	}{
+		{"tenth of the rate", IngestionLimits{RatePerSecond: 1000}, 1, 100},
+		{"at least one for a slow rate", IngestionLimits{RatePerSecond: 5}, 1, 1},
+		{"hundredth of the quota", IngestionLimits{DailyQuota: 100000}, 1, 1000},
+		{"at least one for a small quota", IngestionLimits{DailyQuota: 50}, 1, 1},
+		{"smaller of rate and quota", IngestionLimits{RatePerSecond: 1000, DailyQuota: 5000}, 1, 50},
+		{"never less than needed", IngestionLimits{RatePerSecond: 1000}, 400, 400},
+		{"need with both limits", IngestionLimits{RatePerSecond: 1000, DailyQuota: 5000}, 80, 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leaseSize(tt.limits, tt.need); got != tt.want {
+				t.Errorf("leaseSize(%+v, %d) = %d, want %d", tt.limits, tt.need, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRequestFits(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    IngestionLimits
+		n         int
+		wantLimit string
+	}{
+		{"unlimited", IngestionLimits{}, 1000000, ""},
+		{"within burst", IngestionLimits{RatePerSecond: 10, Burst: 100}, 100, ""},
+		{"over burst", IngestionLimits{RatePerSecond: 10, Burst: 100}, 101, LimitRate},
+		{"over rate without burst", IngestionLimits{RatePerSecond: 10}, 11, LimitRate},
+		{"within quota", IngestionLimits{DailyQuota: 500}, 500, ""},
+		{"over quota", IngestionLimits{DailyQuota: 500}, 501, LimitQuota},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRequestFits(tt.limits, tt.n)
+			if tt.wantLimit == "" {
+				if err != nil {
+					t.Fatalf("checkRequestFits() = %v, want nil", err)
+				}
+				return
+			}
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("checkRequestFits() = %v, want a *LimitError", err)
+			}
+			if limitErr.Limit != tt.wantLimit {
+				t.Errorf("Limit = %q, want %q", limitErr.Limit, tt.wantLimit)
+			}
+			if limitErr.RetryAfter != 0 {
+				t.Errorf("RetryAfter = %v, want 0 for a request that can never fit", limitErr.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestIngestionLimiterRelease(t *testing.T) {
+	const projectID = "project"
+	limits := IngestionLimits{DailyQuota: 1000}
+	today := time.Now().UTC().Format(time.DateOnly)
+
+	tests := []struct {
+		name        string
+		releaseDay  string
+		wantPermits int64
+	}{
+		{"same day is given back", today, 10},
+		{"past day is dropped", "2000-01-01", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &ingestionLimiter{projects: map[string]*projectPermits{
+				projectID: {day: today, permits: 10},
+			}}
+			// Held permits are handed out without a lease.
+			day, err := l.Acquire(context.Background(), projectID, limits, 3)
+			if err != nil {
+				t.Fatalf("Acquire() error = %v", err)
+			}
+			if day != today {
+				t.Fatalf("Acquire() day = %q, want %q", day, today)
+			}
+			l.Release(projectID, tt.releaseDay, 3)
+			if got := l.projects[projectID].permits; got != tt.wantPermits {
+				t.Errorf("permits = %d, want %d", got, tt.wantPermits)
+			}
+		})
+	}
+}
+
+func TestIngestionLimiterAcquireUnlimited(t *testing.T) {
+	l := &ingestionLimiter{projects: make(map[string]*projectPermits)}
+	day, err := l.Acquire(context.Background(), "project", IngestionLimits{}, 5000)
+	if err != nil || day != "" {
+		t.Fatalf("Acquire() = %q, %v, want \"\", nil", day, err)
+	}
+	if len(l.projects) != 0 {
+		t.Errorf("unlimited project was given permits: %v", l.projects)
+	}
+	// enforceIngestionLimits returns no grant for it, and releasing that is
+	// a no-op.
+	var grant *ingestionGrant
+	grant.Release(5000)
+}
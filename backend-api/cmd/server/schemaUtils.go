@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const (
+	// SchemaModeEnforce rejects logs whose payload does not match the schema.
+	SchemaModeEnforce = "enforce"
+	// SchemaModeWarn accepts them and only counts the violation.
+	SchemaModeWarn = "warn"
+
+	// eventSchemaCacheTTL bounds how long a replica keeps using a project's
+	// compiled schemas after they were changed elsewhere.
+	eventSchemaCacheTTL = 30 * time.Second
+	// schemaStatsFlushInterval is how often validation counts are added to
+	// event_schema_stats.
+	schemaStatsFlushInterval = 5 * time.Second
+	// maxSchemaBytes bounds the size of a registered schema.
+	maxSchemaBytes = 64 << 10
+	// maxViolationMessageLength bounds the violation kept in the stats and
+	// returned to clients.
+	maxViolationMessageLength = 500
+	// eventSchemaURL names a schema while it is compiled, so that errors do
+	// not mention the server's working directory.
+	eventSchemaURL = "urn:cloudilogs:event-schema"
+)
+
+func isValidSchemaMode(mode string) bool {
+	return mode == SchemaModeEnforce || mode == SchemaModeWarn
+}
+
+type EventSchemaStats struct {
+	Validated       int64      `json:"validated"`
+	Violations      int64      `json:"violations"`
+	Rejected        int64      `json:"rejected"`
+	LastViolationAt *time.Time `json:"last_violation_at,omitempty"`
+	LastViolation   string     `json:"last_violation,omitempty"`
+}
+
+type EventSchema struct {
+	EventName string           `json:"event_name"`
+	Mode      string           `json:"mode"`
+	Schema    json.RawMessage  `json:"schema"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Stats     EventSchemaStats `json:"stats"`
+}
+
+type PutEventSchemaRequest struct {
+	Schema json.RawMessage `json:"schema"`
+	Mode   string          `json:"mode"`
+}
+
+// SchemaViolationError is returned for a payload that breaks an enforced
+// schema.
+type SchemaViolationError struct {
+	EventName string
+	Message   string
+}
+
+func (e *SchemaViolationError) Error() string {
+	return fmt.Sprintf("full_payload does not match the schema of event '%s': %s", e.EventName, e.Message)
+}
+
+// compileEventSchema compiles a JSON Schema. Schemas cannot reference files or
+// URLs, only themselves and the standard metaschemas.
+func compileEventSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(jsonschema.SchemeURLLoader{})
+	if err := c.AddResource(eventSchemaURL, doc); err != nil {
+		return nil, err
+	}
+	return c.Compile(eventSchemaURL)
+}
+
+// violationMessage turns a validation error into one line listing where the
+// payload went wrong.
+func violationMessage(err error) string {
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err.Error()
+	}
+	// The first line only names the schema's URL.
+	lines := strings.Split(validationErr.Error(), "\n")
+	var causes []string
+	for _, line := range lines[1:] {
+		causes = append(causes, strings.TrimPrefix(strings.TrimSpace(line), "- "))
+	}
+	msg := strings.Join(causes, "; ")
+	if msg == "" {
+		msg = lines[0]
+	}
+	if len(msg) > maxViolationMessageLength {
+		msg = msg[:maxViolationMessageLength] + "..."
+	}
+	return msg
+}
+
+type compiledEventSchema struct {
+	mode     string
+	revision int64
+	schema   *jsonschema.Schema
+}
+
+type cachedProjectSchemas struct {
+	schemas   map[string]*compiledEventSchema
+	fetchedAt time.Time
+}
+
+// eventSchemaCache is a read-through cache of each project's compiled
+// schemas, keyed by event name.
+type eventSchemaCache struct {
+	mu      sync.RWMutex
+	entries map[string]cachedProjectSchemas
+}
+
+var eventSchemas = &eventSchemaCache{entries: make(map[string]cachedProjectSchemas)}
+
+// Get returns the project's schemas. On a lookup error a stale entry is
+// returned if one is cached.
+func (c *eventSchemaCache) Get(ctx context.Context, projectID string) (map[string]*compiledEventSchema, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[projectID]
+	c.mu.RUnlock()
+	if ok && time.Since(entry.fetchedAt) < eventSchemaCacheTTL {
+		return entry.schemas, nil
+	}
+
+	schemas, err := loadEventSchemas(ctx, projectID)
+	if err != nil {
+		if ok {
+			return entry.schemas, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[projectID] = cachedProjectSchemas{schemas: schemas, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return schemas, nil
+}
+
+// Invalidate drops the project's schemas, so the next log reloads them.
+func (c *eventSchemaCache) Invalidate(projectID string) {
+	c.mu.Lock()
+	delete(c.entries, projectID)
+	c.mu.Unlock()
+}
+
+func loadEventSchemas(ctx context.Context, projectID string) (map[string]*compiledEventSchema, error) {
+	rows, err := db.QueryContext(ctx, `SELECT event_name, mode, revision, schema FROM event_schemas WHERE project_id = $1`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := make(map[string]*compiledEventSchema)
+	for rows.Next() {
+		var eventName, mode string
+		var revision int64
+		var raw []byte
+		if err := rows.Scan(&eventName, &mode, &revision, &raw); err != nil {
+			return nil, err
+		}
+		schema, err := compileEventSchema(raw)
+		if err != nil {
+			// Schemas are compiled before they are stored, so this only
+			// happens if the library changed underneath them.
+			slog.Error("Failed to compile stored event schema", "project_id", projectID, "event_name", eventName, "error", err)
+			continue
+		}
+		schemas[eventName] = &compiledEventSchema{mode: mode, revision: revision, schema: schema}
+	}
+	return schemas, rows.Err()
+}
+
+// schemaCheck is the outcome of validating a log against its event's schema.
+type schemaCheck struct {
+	projectID string
+	eventName string
+	revision  int64
+	mode      string
+	// violation says why the payload did not match, empty if it did.
+	violation string
+}
+
+func (c *schemaCheck) rejected() bool {
+	return c.violation != "" && c.mode == SchemaModeEnforce
+}
+
+// checkEventSchema validates the payload against the schema registered for
+// its event name, if any. It returns a *SchemaViolationError only for schemas
+// in enforce mode, and counts those rejections at once. Any other outcome is
+// kept on the payload, for the handler to count once the log is accepted.
+// When the schemas cannot be loaded the log is let through.
+func checkEventSchema(ctx context.Context, logPayload *LogIngestionPayload, project *IngestionProject) error {
+	schemas, err := eventSchemas.Get(ctx, project.ID)
+	if err != nil {
+		slog.Warn("Failed to load event schemas, skipping validation", "project_id", project.ID, "error", err)
+		return nil
+	}
+	s, ok := schemas[logPayload.Name]
+	if !ok {
+		return nil
+	}
+
+	payload := []byte(logPayload.FullPayload)
+	if len(payload) == 0 {
+		payload = []byte("null")
+	}
+	var validationErr error
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		validationErr = err
+	} else {
+		validationErr = s.schema.Validate(instance)
+	}
+	check := &schemaCheck{projectID: project.ID, eventName: logPayload.Name, revision: s.revision, mode: s.mode}
+	if validationErr != nil {
+		check.violation = violationMessage(validationErr)
+	}
+	if !check.rejected() {
+		logPayload.schemaCheck = check
+		return nil
+	}
+	schemaStats.Record(check)
+	return &SchemaViolationError{EventName: logPayload.Name, Message: check.violation}
+}
+
+type schemaStatsKey struct {
+	projectID string
+	eventName string
+	revision  int64
+}
+
+type pendingSchemaStats struct {
+	validated, violations, rejected int64
+	lastViolationAt                 time.Time
+	lastViolation                   string
+}
+
+// schemaStatsRecorder counts validations per event and adds the counts to
+// event_schema_stats every schemaStatsFlushInterval.
+type schemaStatsRecorder struct {
+	mu     sync.Mutex
+	counts map[schemaStatsKey]*pendingSchemaStats
+	wg     sync.WaitGroup
+}
+
+var schemaStats = &schemaStatsRecorder{counts: make(map[schemaStatsKey]*pendingSchemaStats)}
+
+// Record counts one schema check. A nil check, for a log whose event has no
+// schema, is ignored.
+func (s *schemaStatsRecorder) Record(check *schemaCheck) {
+	if check == nil {
+		return
+	}
+	if check.violation != "" {
+		schemaViolations.WithLabelValues(projectLabels.Label(check.projectID), check.mode).Inc()
+	}
+	key := schemaStatsKey{projectID: check.projectID, eventName: check.eventName, revision: check.revision}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counts[key]
+	if !ok {
+		c = &pendingSchemaStats{}
+		s.counts[key] = c
+	}
+	c.validated++
+	if check.violation != "" {
+		c.violations++
+		c.lastViolationAt = time.Now()
+		c.lastViolation = check.violation
+	}
+	if check.rejected() {
+		c.rejected++
+	}
+}
+
+// Drop forgets the pending counts of an event's schema, after it was replaced
+// or deleted.
+func (s *schemaStatsRecorder) Drop(projectID, eventName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.counts {
+		if key.projectID == projectID && key.eventName == eventName {
+			delete(s.counts, key)
+		}
+	}
+}
+
+// Start flushes the counts until ctx is cancelled, and once more after that.
+func (s *schemaStatsRecorder) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(schemaStatsFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), schemaStatsFlushInterval)
+				s.flush(flushCtx)
+				cancel()
+				return
+			case <-ticker.C:
+				s.flush(ctx)
+			}
+		}
+	}()
+}
+
+// Wait blocks until the final flush is done.
+func (s *schemaStatsRecorder) Wait() {
+	s.wg.Wait()
+}
+
+// flush writes the pending counts. Counts that fail to be written are
+// dropped; the stats are informational and must not grow without bound while
+// CockroachDB is down. Counts of a schema revision that was replaced or
+// deleted in the meantime, here or on another replica, fail the foreign key
+// and are dropped as well.
+func (s *schemaStatsRecorder) flush(ctx context.Context) {
+	s.mu.Lock()
+	counts := s.counts
+	s.counts = make(map[schemaStatsKey]*pendingSchemaStats)
+	s.mu.Unlock()
+
+	for key, c := range counts {
+		var lastViolationAt sql.NullTime
+		var lastViolation sql.NullString
+		if c.violations > 0 {
+			lastViolationAt = sql.NullTime{Time: c.lastViolationAt, Valid: true}
+			lastViolation = sql.NullString{String: c.lastViolation, Valid: true}
+		}
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO event_schema_stats (project_id, event_name, revision, validated, violations, rejected, last_violation_at, last_violation, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now())
+			ON CONFLICT (project_id, event_name, revision) DO UPDATE SET
+				validated = event_schema_stats.validated + excluded.validated,
+				violations = event_schema_stats.violations + excluded.violations,
+				rejected = event_schema_stats.rejected + excluded.rejected,
+				last_violation_at = COALESCE(excluded.last_violation_at, event_schema_stats.last_violation_at),
+				last_violation = COALESCE(excluded.last_violation, event_schema_stats.last_violation),
+				updated_at = now()
+		`, key.projectID, key.eventName, key.revision, c.validated, c.violations, c.rejected, lastViolationAt, lastViolation)
+		if err != nil && !isForeignKeyViolation(err) {
+			slog.Warn("Failed to record event schema stats", "project_id", key.projectID, "event_name", key.eventName, "error", err)
+		}
+	}
+}
+
+func eventSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["projectId"]
+	if _, _, ok := authorizeProject(w, r, projectID, PermissionViewProject); !ok {
+		return
+	}
+
+	schemas, err := queryEventSchemas(projectID, "")
+	if err != nil {
+		requestLogger(r).Error("Failed to list event schemas", "project_id", projectID, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Database error on event schema fetch")
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, schemas)
+}
+
+func eventSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectId"]
+	eventName := vars["eventName"]
+
+	switch r.Method {
+	case "GET":
+		if _, _, ok := authorizeProject(w, r, projectID, PermissionViewProject); !ok {
+			return
+		}
+		getEventSchemaHandler(w, r, projectID, eventName)
+	case "PUT":
+		userID, _, ok := authorizeProject(w, r, projectID, PermissionManageProject)
+		if !ok {
+			return
+		}
+		putEventSchemaHandler(w, r, projectID, eventName, userID)
+	case "DELETE":
+		if _, _, ok := authorizeProject(w, r, projectID, PermissionManageProject); !ok {
+			return
+		}
+		deleteEventSchemaHandler(w, projectID, eventName)
+	default:
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// queryEventSchemas returns the project's schemas with their stats, or only
+// the one of eventName if it is set.
+func queryEventSchemas(projectID, eventName string) ([]EventSchema, error) {
+	query := `
+		SELECT s.event_name, s.mode, s.schema, s.created_at, s.updated_at,
+		       COALESCE(st.validated, 0), COALESCE(st.violations, 0), COALESCE(st.rejected, 0),
+		       st.last_violation_at, st.last_violation
+		FROM event_schemas s
+		LEFT JOIN event_schema_stats st
+		       ON st.project_id = s.project_id AND st.event_name = s.event_name AND st.revision = s.revision
+		WHERE s.project_id = $1`
+	args := []interface{}{projectID}
+	if eventName != "" {
+		query += " AND s.event_name = $2"
+		args = append(args, eventName)
+	}
+	rows, err := db.Query(query+" ORDER BY s.event_name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := []EventSchema{}
+	for rows.Next() {
+		var s EventSchema
+		var raw []byte
+		var lastViolationAt sql.NullTime
+		var lastViolation sql.NullString
+		if err := rows.Scan(&s.EventName, &s.Mode, &raw, &s.CreatedAt, &s.UpdatedAt,
+			&s.Stats.Validated, &s.Stats.Violations, &s.Stats.Rejected, &lastViolationAt, &lastViolation); err != nil {
+			return nil, err
+		}
+		s.Schema = json.RawMessage(raw)
+		if lastViolationAt.Valid {
+			s.Stats.LastViolationAt = &lastViolationAt.Time
+		}
+		s.Stats.LastViolation = lastViolation.String
+		schemas = append(schemas, s)
+	}
+	return schemas, rows.Err()
+}
+
+func getEventSchemaHandler(w http.ResponseWriter, r *http.Request, projectID, eventName string) {
+	schemas, err := queryEventSchemas(projectID, eventName)
+	if err != nil {
+		requestLogger(r).Error("Failed to fetch event schema", "project_id", projectID, "event_name", eventName, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Database error on event schema fetch")
+		return
+	}
+	if len(schemas) == 0 {
+		RespondWithError(w, http.StatusNotFound, "No schema registered for this event")
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, schemas[0])
+}
+
+// putEventSchemaHandler registers or replaces the schema of an event. The
+// schema is compiled first, so only valid schemas are stored. Every stored
+// schema gets a new revision and starts with empty stats, including one that
+// was deleted and registered again.
+func putEventSchemaHandler(w http.ResponseWriter, r *http.Request, projectID, eventName, userID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSchemaBytes)
+	var req PutEventSchemaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, message := bodyReadError(err)
+		RespondWithError(w, status, message)
+		return
+	}
+	if len(req.Schema) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "schema is required")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = SchemaModeEnforce
+	}
+	if !isValidSchemaMode(req.Mode) {
+		RespondWithError(w, http.StatusBadRequest, "mode must be one of: enforce, warn")
+		return
+	}
+	if _, err := compileEventSchema(req.Schema); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid JSON Schema: "+violationMessage(err))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	// The stats reference the revision being replaced, so they go first.
+	if _, err := tx.Exec("DELETE FROM event_schema_stats WHERE project_id = $1 AND event_name = $2", projectID, eventName); err != nil {
+		requestLogger(r).Error("Failed to reset event schema stats", "project_id", projectID, "event_name", eventName, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to store event schema")
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO event_schemas (project_id, event_name, mode, schema, created_by) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (project_id, event_name) DO UPDATE SET
+			mode = excluded.mode, schema = excluded.schema, revision = unique_rowid(), updated_at = now()
+	`, projectID, eventName, req.Mode, []byte(req.Schema), userID)
+	if err != nil {
+		requestLogger(r).Error("Failed to store event schema", "project_id", projectID, "event_name", eventName, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to store event schema")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	schemaStats.Drop(projectID, eventName)
+	eventSchemas.Invalidate(projectID)
+
+	getEventSchemaHandler(w, r, projectID, eventName)
+}
+
+// deleteEventSchemaHandler stops validating an event. Its stats are deleted
+// with it by the foreign key.
+func deleteEventSchemaHandler(w http.ResponseWriter, projectID, eventName string) {
+	res, err := db.Exec("DELETE FROM event_schemas WHERE project_id = $1 AND event_name = $2", projectID, eventName)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to delete event schema")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		RespondWithError(w, http.StatusNotFound, "No schema registered for this event")
+		return
+	}
+	schemaStats.Drop(projectID, eventName)
+	eventSchemas.Invalidate(projectID)
+
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEventSchema = `{
+	"type": "object",
+	"required": ["user_id"],
+	"properties": {
+		"user_id": {"type": "string"},
+		"attempts": {"type": "integer", "minimum": 0}
+	}
+}`
+
+func TestViolationMessage(t *testing.T) {
+	schema, err := compileEventSchema(json.RawMessage(testEventSchema))
+	if err != nil {
+		t.Fatalf("compileEventSchema() error = %v", err)
+	}
+	tests := []struct {
+		name         string
+		instance     interface{}
+		wantContains []string
+	}{
+		{"missing property", map[string]interface{}{}, []string{"user_id"}},
+		{"wrong type", map[string]interface{}{"user_id": 42.0}, []string{"/user_id"}},
+		{"several causes", map[string]interface{}{"user_id": 42.0, "attempts": -1.0}, []string{"/user_id", "/attempts", "; "}},
+		{"not an object", "login", []string{"object"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validationErr := schema.Validate(tt.instance)
+			if validationErr == nil {
+				t.Fatal("Validate() = nil, want a violation")
+			}
+			msg := violationMessage(validationErr)
+			if strings.Contains(msg, "\n") || strings.Contains(msg, eventSchemaURL) {
+				t.Errorf("violationMessage() = %q, want one line without the schema's URL", msg)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(msg, want) {
+					t.Errorf("violationMessage() = %q, want it to mention %q", msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestViolationMessageTruncates(t *testing.T) {
+	required := make([]string, 100)
+	for i := range required {
+		required[i] = fmt.Sprintf("a_rather_long_property_name_%03d", i)
+	}
+	raw, _ := json.Marshal(map[string]interface{}{"type": "object", "required": required})
+	schema, err := compileEventSchema(raw)
+	if err != nil {
+		t.Fatalf("compileEventSchema() error = %v", err)
+	}
+	msg := violationMessage(schema.Validate(map[string]interface{}{}))
+	if len(msg) != maxViolationMessageLength+len("...") || !strings.HasSuffix(msg, "...") {
+		t.Errorf("violationMessage() is %d bytes, want it cut at %d", len(msg), maxViolationMessageLength)
+	}
+}
+
+func TestViolationMessageOtherErrors(t *testing.T) {
+	err := errors.New("invalid character 'x' looking for beginning of value")
+	if msg := violationMessage(err); msg != err.Error() {
+		t.Errorf("violationMessage() = %q, want %q", msg, err.Error())
+	}
+}
+
+func TestCheckEventSchema(t *testing.T) {
+	const projectID = "schema-test-project"
+	schema, err := compileEventSchema(json.RawMessage(testEventSchema))
+	if err != nil {
+		t.Fatalf("compileEventSchema() error = %v", err)
+	}
+	// Seeding the cache keeps the lookup from reaching CockroachDB.
+	eventSchemas.mu.Lock()
+	eventSchemas.entries[projectID] = cachedProjectSchemas{
+		schemas: map[string]*compiledEventSchema{
+			"enforced": {mode: SchemaModeEnforce, revision: 1, schema: schema},
+			"warned":   {mode: SchemaModeWarn, revision: 2, schema: schema},
+		},
+		fetchedAt: time.Now(),
+	}
+	eventSchemas.mu.Unlock()
+	t.Cleanup(func() {
+		eventSchemas.Invalidate(projectID)
+		schemaStats.Drop(projectID, "enforced")
+		schemaStats.Drop(projectID, "warned")
+	})
+
+	tests := []struct {
+		name          string
+		event         string
+		payload       string
+		wantRejected  bool
+		wantCheck     bool
+		wantViolation bool
+	}{
+		{"event without a schema", "other", `{}`, false, false, false},
+		{"valid payload", "enforced", `{"user_id":"u1"}`, false, true, false},
+		{"enforced violation", "enforced", `{"user_id":1}`, true, false, true},
+		{"missing payload is null", "enforced", ``, true, false, true},
+		{"unparsable payload", "enforced", `{"user_id":`, true, false, true},
+		{"warned violation", "warned", `{}`, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemaStats.Drop(projectID, tt.event)
+			logPayload := &LogIngestionPayload{Name: tt.event, FullPayload: json.RawMessage(tt.payload)}
+			err := checkEventSchema(context.Background(), logPayload, &IngestionProject{ID: projectID})
+
+			var violationErr *SchemaViolationError
+			if rejected := errors.As(err, &violationErr); rejected != tt.wantRejected {
+				t.Fatalf("checkEventSchema() error = %v, want rejected = %v", err, tt.wantRejected)
+			}
+			if err != nil && !tt.wantRejected {
+				t.Fatalf("checkEventSchema() error = %v", err)
+			}
+			check := logPayload.schemaCheck
+			if (check != nil) != tt.wantCheck {
+				t.Fatalf("schemaCheck = %+v, want one kept on the payload = %v", check, tt.wantCheck)
+			}
+			if check != nil && (check.violation != "") != tt.wantViolation {
+				t.Errorf("schemaCheck.violation = %q, want a violation = %v", check.violation, tt.wantViolation)
+			}
+
+			// Only rejections are counted at once; the rest waits for the
+			// log to be accepted.
+			schemaStats.mu.Lock()
+			var pending *pendingSchemaStats
+			for key, c := range schemaStats.counts {
+				if key.projectID == projectID && key.eventName == tt.event {
+					pending = c
+				}
+			}
+			schemaStats.mu.Unlock()
+			if tt.wantRejected {
+				if pending == nil || pending.validated != 1 || pending.violations != 1 || pending.rejected != 1 {
+					t.Errorf("pending stats = %+v, want one rejected violation", pending)
+				}
+			} else if pending != nil {
+				t.Errorf("pending stats = %+v, want none before the log is accepted", pending)
+			}
+		})
+	}
+}
+
+func TestSchemaStatsRecorder(t *testing.T) {
+	s := &schemaStatsRecorder{counts: make(map[schemaStatsKey]*pendingSchemaStats)}
+	valid := &schemaCheck{projectID: "p1", eventName: "login", revision: 1, mode: SchemaModeWarn}
+	warned := &schemaCheck{projectID: "p1", eventName: "login", revision: 1, mode: SchemaModeWarn, violation: "missing user_id"}
+	replaced := &schemaCheck{projectID: "p1", eventName: "login", revision: 2, mode: SchemaModeWarn}
+	other := &schemaCheck{projectID: "p1", eventName: "logout", revision: 1, mode: SchemaModeWarn}
+
+	s.Record(nil)
+	s.Record(valid)
+	s.Record(warned)
+	s.Record(replaced)
+	s.Record(other)
+
+	got := s.counts[schemaStatsKey{projectID: "p1", eventName: "login", revision: 1}]
+	if got == nil || got.validated != 2 || got.violations != 1 || got.rejected != 0 || got.lastViolation != "missing user_id" {
+		t.Errorf("stats of revision 1 = %+v, want 2 validated with 1 violation", got)
+	}
+	if len(s.counts) != 3 {
+		t.Errorf("counts has %d entries, want one per project, event and revision", len(s.counts))
+	}
+
+	s.Drop("p1", "login")
+	if len(s.counts) != 1 {
+		t.Errorf("counts has %d entries after Drop, want only the other event's", len(s.counts))
+	}
+	if _, ok := s.counts[schemaStatsKey{projectID: "p1", eventName: "logout", revision: 1}]; !ok {
+		t.Error("Drop removed the counts of another event")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -25,7 +26,6 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE TABLE IF NOT EXISTS projects (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     name STRING(255) NOT NULL,
-    api_key STRING(64) UNIQUE NOT NULL,
     searchable_keys STRING[],
     log_ttl_seconds INT NOT NULL,
     owner_id UUID NOT NULL REFERENCES users(id) ON DELETE RESTRICT,
@@ -35,7 +35,6 @@ CREATE TABLE IF NOT EXISTS projects (
     updated_at TIMESTAMPTZ DEFAULT now(),
     UNIQUE (owner_id, name)
 );
-CREATE INDEX IF NOT EXISTS projects_api_key_idx ON projects (api_key);
 CREATE INDEX IF NOT EXISTS projects_owner_id_idx ON projects (owner_id);
 
 CREATE TABLE IF NOT EXISTS user_project_access (
@@ -44,6 +43,96 @@ CREATE TABLE IF NOT EXISTS user_project_access (
     assigned_at TIMESTAMPTZ DEFAULT now(),
     PRIMARY KEY (user_id, project_id)
 );
+
+CREATE TABLE IF NOT EXISTS project_api_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    key_hash STRING(64) UNIQUE NOT NULL,
+    key_prefix STRING(16) NOT NULL,
+    label STRING(255) NOT NULL DEFAULT '',
+    scopes STRING[] NOT NULL DEFAULT ARRAY['ingest'],
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS project_api_keys_project_id_idx ON project_api_keys (project_id);
+
+-- project_jobs tracks background work on a project, such as purging its logs
+-- when it is deleted. Jobs outlive their project, so project_id is not a
+-- foreign key.
+CREATE TABLE IF NOT EXISTS project_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL,
+    kind STRING(32) NOT NULL,
+    status STRING(16) NOT NULL DEFAULT 'pending',
+    step STRING(32) NOT NULL DEFAULT '',
+    error STRING,
+    attempts INT NOT NULL DEFAULT 0,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    run_after TIMESTAMPTZ NOT NULL DEFAULT now(),
+    lease_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    updated_at TIMESTAMPTZ DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS project_jobs_status_run_after_idx ON project_jobs (status, run_after);
+CREATE INDEX IF NOT EXISTS project_jobs_project_id_idx ON project_jobs (project_id);
+
+-- project_rate_buckets holds each rate-limited project's shared token bucket,
+-- from which backend-api replicas lease tokens.
+CREATE TABLE IF NOT EXISTS project_rate_buckets (
+    project_id UUID PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+    tokens FLOAT8 NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- project_usage counts the logs accepted for each project per UTC day, and
+-- how much of the day's quota replicas have reserved.
+CREATE TABLE IF NOT EXISTS project_usage (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    logs_accepted INT8 NOT NULL DEFAULT 0,
+    logs_reserved INT8 NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (project_id, day)
+);
+
+-- event_schemas holds the JSON Schema a project's payloads of one event name
+-- are validated against. mode is 'enforce' (reject) or 'warn' (count only).
+-- revision changes every time the schema is registered or replaced.
+CREATE TABLE IF NOT EXISTS event_schemas (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    event_name STRING NOT NULL,
+    mode STRING NOT NULL DEFAULT 'enforce',
+    schema JSONB NOT NULL,
+    revision INT8 NOT NULL DEFAULT unique_rowid(),
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (project_id, event_name),
+    CONSTRAINT event_schemas_revision_key UNIQUE (project_id, event_name, revision)
+);
+
+-- event_schema_stats counts the payloads validated against one revision of an
+-- event's schema and those that violated it. Replacing or deleting the schema
+-- deletes its stats, and counts flushed for a revision that no longer exists
+-- fail the foreign key.
+CREATE TABLE IF NOT EXISTS event_schema_stats (
+    project_id UUID NOT NULL,
+    event_name STRING NOT NULL,
+    revision INT8 NOT NULL,
+    validated INT8 NOT NULL DEFAULT 0,
+    violations INT8 NOT NULL DEFAULT 0,
+    rejected INT8 NOT NULL DEFAULT 0,
+    last_violation_at TIMESTAMPTZ,
+    last_violation STRING,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (project_id, event_name, revision),
+    FOREIGN KEY (project_id, event_name, revision)
+        REFERENCES event_schemas (project_id, event_name, revision) ON DELETE CASCADE
+);
 `
 
 func main() {
@@ -91,19 +180,72 @@ func main() {
 
 func runMigrations(db *sql.DB) {
 	// Migration 1: Add 'role' column to 'user_project_access' table
-	var columnExists int
-	query := `SELECT 1 FROM [SHOW COLUMNS FROM user_project_access] WHERE column_name = 'role'`
-	err := db.QueryRow(query).Scan(&columnExists)
+	addColumnIfMissing(db, "user_project_access", "role", "STRING(50) NOT NULL DEFAULT 'member'")
+
+	// Migration 2: Add 'searchable_keys_policy' column to 'projects' table
+	addColumnIfMissing(db, "projects", "searchable_keys_policy", "STRING(10) NOT NULL DEFAULT 'allow'")
+
+	// Migration 3: Move each project's original plaintext key into
+	// 'project_api_keys' as a hash and drop 'projects.api_key'
+	if columnExists(db, "projects", "api_key") {
+		log.Println("Migration: moving 'projects.api_key' into 'project_api_keys'...")
+		res, err := db.Exec(`
+			INSERT INTO project_api_keys (project_id, key_hash, key_prefix, label, scopes, created_by, created_at)
+			SELECT p.id, sha256(p.api_key), substr(p.api_key, 1, 8), 'default', ARRAY['ingest', 'read'], p.owner_id, p.created_at
+			FROM projects p
+			WHERE NOT EXISTS (SELECT 1 FROM project_api_keys k WHERE k.key_hash = sha256(p.api_key))
+		`)
+		if err != nil {
+			log.Fatalf("Failed to copy project API keys into 'project_api_keys': %v", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Migration: copied %d project API keys into 'project_api_keys'.", n)
+		}
+		if _, err := db.Exec(`DROP INDEX IF EXISTS projects@projects_api_key_idx`); err != nil {
+			log.Fatalf("Failed to drop 'projects_api_key_idx': %v", err)
+		}
+		if _, err := db.Exec(`ALTER TABLE projects DROP COLUMN api_key CASCADE`); err != nil {
+			log.Fatalf("Failed to drop 'projects.api_key': %v", err)
+		}
+		log.Println("Migration: 'projects.api_key' dropped successfully.")
+	}
+
+	// Migration 4: Add ingestion rate limit and daily quota columns to
+	// 'projects'; 0 means unlimited
+	addColumnIfMissing(db, "projects", "rate_limit_per_second", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "rate_limit_burst", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "daily_log_quota", "INT8 NOT NULL DEFAULT 0")
+
+	// Migration 5: Add per-project payload limit columns to 'projects'; 0 or
+	// an empty pattern means the server default
+	addColumnIfMissing(db, "projects", "max_body_bytes", "INT8 NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "max_payload_bytes", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "max_searchable_keys", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "max_searchable_value_length", "INT NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "projects", "event_name_pattern", "STRING NOT NULL DEFAULT ''")
+}
+
+func columnExists(db *sql.DB, table, column string) bool {
+	var exists int
+	query := fmt.Sprintf(`SELECT 1 FROM [SHOW COLUMNS FROM %s] WHERE column_name = $1`, table)
+	err := db.QueryRow(query, column).Scan(&exists)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Println("Migration: 'role' column not found in 'user_project_access'. Adding it...")
-			alterQuery := `ALTER TABLE user_project_access ADD COLUMN role STRING(50) NOT NULL DEFAULT 'member'`
-			if _, alterErr := db.Exec(alterQuery); alterErr != nil {
-				log.Fatalf("Failed to execute migration to add 'role' column: %v", alterErr)
-			}
-			log.Println("Migration: 'role' column added successfully.")
-		} else {
-			log.Fatalf("Failed to check for 'role' column existence: %v", err)
+			return false
 		}
+		log.Fatalf("Failed to check for '%s' column existence: %v", column, err)
+	}
+	return true
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) {
+	if columnExists(db, table, column) {
+		return
+	}
+	log.Printf("Migration: '%s' column not found in '%s'. Adding it...", column, table)
+	alterQuery := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)
+	if _, err := db.Exec(alterQuery); err != nil {
+		log.Fatalf("Failed to execute migration to add '%s' column: %v", column, err)
 	}
+	log.Printf("Migration: '%s' column added successfully.", column)
 }
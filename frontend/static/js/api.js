@@ -41,6 +41,10 @@ export const api = {
     getProjects: () => request('/projects'),
     createProject: (projectData) => request('/projects', { body: projectData }),
     getApiKey: (projectId) => request(`/projects/${projectId}/apikey`),
+    getApiKeys: (projectId) => request(`/projects/${projectId}/apikeys`),
+    createApiKey: (projectId, keyData) => request(`/projects/${projectId}/apikeys`, { body: keyData }),
+    rotateApiKey: (projectId, keyId, graceSeconds) => request(`/projects/${projectId}/apikeys/${keyId}/rotate`, { body: { grace_seconds: graceSeconds } }),
+    revokeApiKey: (projectId, keyId) => request(`/projects/${projectId}/apikeys/${keyId}`, { method: 'DELETE' }),
     getLogs: (projectId, params) => {
         const query = new URLSearchParams(params).toString();
         return request(`/projects/${projectId}/logs?${query}`);
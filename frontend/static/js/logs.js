@@ -37,6 +37,9 @@ document.addEventListener("DOMContentLoaded", async () => {
   let individualLogs = [];
   let currentLogIndex = -1;
   let currentSearchParams = null;
+  let nextCursor = null;
+  let hasMoreLogs = false;
+  let loadingMoreLogs = false;
 
   let max_visited_log_index = 0;
 
@@ -90,7 +93,10 @@ document.addEventListener("DOMContentLoaded", async () => {
   const fetchIndividualLogs = async (eventName) => {
     try {
       const params = { event_name: eventName, ...currentSearchParams };
-      individualLogs = await api.getLogs(projectId, params);
+      const page = await api.getLogs(projectId, params);
+      individualLogs = page.logs;
+      nextCursor = page.next_cursor || null;
+      hasMoreLogs = page.has_more;
       currentEventName = eventName;
 
       console.log(currentEventName)
@@ -179,7 +185,7 @@ document.addEventListener("DOMContentLoaded", async () => {
 
   const updateNavButtons = () => {
     prevLogBtn.disabled = currentLogIndex <= 0;
-    nextLogBtn.disabled = currentLogIndex >= individualLogs.length - 1 && individualLogs.length % 100 !== 0;
+    nextLogBtn.disabled = currentLogIndex >= individualLogs.length - 1 && !hasMoreLogs;
     // Update the index indicator
     if (individualLogs.length > 0 && currentLogIndex >= 0) {
       logIndexIndicator.textContent = `${currentLogIndex + 1} of ${
@@ -188,45 +194,32 @@ document.addEventListener("DOMContentLoaded", async () => {
     } else {
       logIndexIndicator.textContent = "";
     }
-    sendLogRequest(currentLogIndex);
-
-    // if(currentLogIndex % 100 == 0){
-    //     // we want to send network a request with url of sth like http://localhost:8084/api/projects/308eacef-a15d-43a6-9727-c8396124bfe0/logs?event_name=login_success&offset=100
-    //     // at first we will use http://localhost:8084/api/projects/308eacef-a15d-43a6-9727-c8396124bfe0/logs?event_name=login_success
-    // }
+    loadMoreLogsIfNeeded(currentLogIndex);
   };
 
-  function sendLogRequest(currentLogIndex) {
-  const BASE_URL = "http://localhost:8084/api/projects";
-  if (!currentEventName) return;
-
-    if (currentLogIndex % 96 === 0 && max_visited_log_index === currentLogIndex && currentLogIndex>0) {
-
-        const offset = (Math.floor(currentLogIndex / 100) + 1) * 100;
-
-        const url = `${BASE_URL}/${projectId}/logs?event_name=${currentEventName}&offset=${offset}`;
-        console.log(`Sending request to: ${url}`);
-
-        fetch(url)
-            .then((res) => {
-            if (!res.ok) throw new Error("Network response was not ok");
-            return res.json();
-            })
-            .then((data) => {
-            if (!Array.isArray(data) || data.length === 0) {
-                console.warn("No additional logs received.");
-                return;
-            }
-
-            individualLogs = individualLogs.concat(data);
-            currentLogIndex += 1;
-            showLogDetails(currentLogIndex);
-            })
-            .catch((error) => {
-            console.error("Fetch error:", error);
-            });
-        }
-}
+  /**
+   * Fetches the next page of logs with the cursor from the previous page
+   * once the user gets close to the end of the loaded logs.
+   * @param {number} index - The index of the log being shown.
+   */
+  async function loadMoreLogsIfNeeded(index) {
+    if (!currentEventName || !hasMoreLogs || loadingMoreLogs) return;
+    if (index < individualLogs.length - 5 || index < max_visited_log_index) return;
+
+    loadingMoreLogs = true;
+    try {
+      const params = { event_name: currentEventName, ...currentSearchParams, cursor: nextCursor };
+      const page = await api.getLogs(projectId, params);
+      individualLogs = individualLogs.concat(page.logs);
+      nextCursor = page.next_cursor || null;
+      hasMoreLogs = page.has_more;
+      updateNavButtons();
+    } catch (error) {
+      console.error("Error fetching more logs:", error);
+    } finally {
+      loadingMoreLogs = false;
+    }
+  }
 
   // Helper Functions for Rendering
   const escapeHTML = (str) => {
@@ -295,7 +288,7 @@ document.addEventListener("DOMContentLoaded", async () => {
   };
 
   const handleNextLog = () => {
-    if (currentLogIndex < individualLogs.length - 1 || individualLogs.length %100 == 0) {
+    if (currentLogIndex < individualLogs.length - 1) {
       showLogDetails(currentLogIndex + 1);
     }
   };
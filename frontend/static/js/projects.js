@@ -34,8 +34,9 @@ document.addEventListener('DOMContentLoaded', async () => {
                     <td><a href="/logs.html?projectId=${project.id}&projectName=${project.name}">${project.name}</a></td>
                     <td>${project.description || ''}</td>
                     <td>${project.id}</td>
+                    <td>${project.role || ''}</td>
                     <td data-project-id="${project.id}">
-                        <button class="get-api-key-btn">Show API Key</button>
+                        ${project.role === 'admin' ? '<button class="get-api-key-btn">Show API Key</button>' : ''}
                     </td>
                 `;
                 projectsTableBody.appendChild(row);
@@ -65,8 +66,11 @@ document.addEventListener('DOMContentLoaded', async () => {
         button.textContent = 'Loading...';
 
         try {
+            // Only the key prefix is stored; a full key is shown once, when it is issued.
             const data = await api.getApiKey(projectId);
-            cell.innerHTML = `<span class="api-key" title="Click to copy">${data.api_key}</span>`;
+            cell.dataset.keyId = data.id;
+            cell.innerHTML = `<span title="Key prefix">${data.key_prefix}&hellip;</span>
+                <button class="rotate-api-key-btn" title="Issue a new key; the current one keeps working for an hour">Rotate</button>`;
         } catch (error) {
             console.error('Error fetching API key:', error);
             button.textContent = 'Error';
@@ -74,6 +78,24 @@ document.addEventListener('DOMContentLoaded', async () => {
         }
     };
 
+    const handleRotateApiKey = async (e) => {
+        if (!e.target.classList.contains('rotate-api-key-btn')) return;
+
+        const button = e.target;
+        const cell = button.parentElement;
+
+        button.disabled = true;
+        try {
+            const data = await api.rotateApiKey(cell.dataset.projectId, cell.dataset.keyId, 3600);
+            cell.dataset.keyId = data.api_key.id;
+            cell.innerHTML = `<span class="api-key" title="Click to copy. This key will not be shown again.">${data.api_key.api_key}</span>`;
+        } catch (error) {
+            console.error('Error rotating API key:', error);
+            button.textContent = 'Error';
+            button.style.color = 'red';
+        }
+    };
+
     const handleCopyToClipboard = (e) => {
         if (!e.target.classList.contains('api-key')) return;
 
@@ -99,12 +121,14 @@ document.addEventListener('DOMContentLoaded', async () => {
             name: formData.get('name'),
             description: formData.get('description'),
             searchable_keys: searchableKeys,
+            searchable_keys_policy: formData.get('searchable_keys_policy'),
             log_ttl_seconds: parseInt(formData.get('log_ttl_seconds'), 10),
         };
 
         try {
-            await api.createProject(data);
+            const project = await api.createProject(data);
             createProjectForm.reset();
+            window.prompt('Project created. Copy its API key now, it will not be shown again:', project.api_key);
             await fetchAndRenderProjects();
         } catch (error) {
             console.error('Error creating project:', error);
@@ -122,6 +146,7 @@ document.addEventListener('DOMContentLoaded', async () => {
             window.location.href = e.target.href;
         }
         handleGetApiKey(e);
+        handleRotateApiKey(e);
         handleCopyToClipboard(e);
     });
 
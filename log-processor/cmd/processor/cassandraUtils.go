@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// cassandraChunk is a group of logs of one project written together. Logs of
+// one project share a partition of the logs table, so they are sent as an
+// unlogged batch, which Cassandra applies as a single mutation.
+type cassandraChunk struct {
+	logs []*pendingLog
+}
+
+// writeCassandra writes the batch's logs with p.cassandraWorkers goroutines.
+// Every project is owned by exactly one worker, so writes to a partition are
+// never reordered and each partition is handled by a single goroutine.
+// Failed writes are retried until they succeed; a chunk Cassandra refuses as
+// invalid is split up so that only the logs it refuses are marked poison. It
+// returns false if ctx ended first.
+func (p *processor) writeCassandra(ctx context.Context, batch *pendingBatch) bool {
+	workQueues := make([][]cassandraChunk, p.cassandraWorkers)
+	byProject := make(map[string][]*pendingLog)
+	var projects []string
+	for _, l := range batch.logs {
+		if !l.writable() {
+			continue
+		}
+		projectID := l.entry.ProjectID
+		if _, ok := byProject[projectID]; !ok {
+			projects = append(projects, projectID)
+		}
+		byProject[projectID] = append(byProject[projectID], l)
+	}
+	for _, projectID := range projects {
+		worker := workerFor(projectID, p.cassandraWorkers)
+		logs := byProject[projectID]
+		for start := 0; start < len(logs); start += p.cassandraBatchSize {
+			end := min(start+p.cassandraBatchSize, len(logs))
+			workQueues[worker] = append(workQueues[worker], cassandraChunk{logs: logs[start:end]})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, queue := range workQueues {
+		if len(queue) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(queue []cassandraChunk) {
+			defer wg.Done()
+			for _, chunk := range queue {
+				p.writeCassandraChunkUntilDone(ctx, chunk)
+			}
+		}(queue)
+	}
+	wg.Wait()
+	return ctx.Err() == nil
+}
+
+// writeCassandraChunkUntilDone writes the chunk, retrying transient errors
+// until ctx is done. If Cassandra refuses the chunk as invalid, its logs are
+// written one at a time and the ones it still refuses are marked poison.
+func (p *processor) writeCassandraChunkUntilDone(ctx context.Context, chunk cassandraChunk) {
+	err := retryUntilDone(ctx, func() error {
+		defer observeWrite(sinkCassandra, time.Now())
+		return p.writeCassandraChunk(ctx, chunk)
+	})
+	if err == nil {
+		sinkWrites.WithLabelValues(sinkCassandra).Add(float64(len(chunk.logs)))
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if len(chunk.logs) > 1 {
+		for _, l := range chunk.logs {
+			p.writeCassandraChunkUntilDone(ctx, cassandraChunk{logs: []*pendingLog{l}})
+		}
+		return
+	}
+	sinkFailures.WithLabelValues(sinkCassandra).Inc()
+	chunk.logs[0].err = err
+}
+
+// writeCassandraChunk writes a chunk's rows to the logs table as one unlogged
+// batch and then its logs_by_id rows, which live in separate partitions, as
+// concurrent single-row inserts. Retrying it is safe because a log's ID is
+// derived from its message, so a second write overwrites the first.
+func (p *processor) writeCassandraChunk(ctx context.Context, chunk cassandraChunk) error {
+	batch := p.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	for _, l := range chunk.logs {
+		logPayload := l.entry.Payload
+		batch.Query(
+			`INSERT INTO logs (project_id, event_timestamp, log_id, event_name, payload, searchable_keys) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+			l.entry.ProjectID, logPayload.Timestamp, l.entry.LogID, logPayload.Name, string(logPayload.FullPayload), logPayload.SearchableKeys, l.settings.CassandraTTL(),
+		)
+	}
+	if err := p.session.ExecuteBatch(batch); err != nil {
+		return cassandraWriteError(fmt.Errorf("insert logs into Cassandra: %w", err))
+	}
+
+	errs := make(chan error, len(chunk.logs))
+	for _, l := range chunk.logs {
+		go func(l *pendingLog) {
+			errs <- p.session.Query(
+				`INSERT INTO logs_by_id (project_id, log_id, event_timestamp) VALUES (?, ?, ?) USING TTL ?`,
+				l.entry.ProjectID, l.entry.LogID, l.entry.Payload.Timestamp, l.settings.CassandraTTL(),
+			).WithContext(ctx).Exec()
+		}(l)
+	}
+	var firstErr error
+	for range chunk.logs {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return cassandraWriteError(fmt.Errorf("insert logs into Cassandra lookup table: %w", firstErr))
+	}
+	return nil
+}
+
+// cassandraWriteError marks errors for requests Cassandra refuses as invalid,
+// such as a value over its size limits, as poison. Everything else, like
+// timeouts and unavailable replicas, is worth retrying.
+func cassandraWriteError(err error) error {
+	var reqErr gocql.RequestError
+	if errors.As(err, &reqErr) && reqErr.Code() == gocql.ErrCodeInvalid {
+		return &poisonError{err}
+	}
+	return err
+}
+
+// workerFor maps a project to one of n workers.
+func workerFor(projectID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(projectID))
+	return int(h.Sum32() % uint32(n))
+}
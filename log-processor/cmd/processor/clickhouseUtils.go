@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// existingIDsChunkSize bounds the number of log IDs in one lookup query, which
+// keeps it well below ClickHouse's max_query_size.
+const existingIDsChunkSize = 1000
+
+// insertClickHouseBatch inserts the logs into ClickHouse as a single block.
+// Logs that are already stored, because their message was redelivered after
+// an earlier insert, are skipped, so inserting a batch again is harmless. A
+// log whose row ClickHouse cannot convert is marked poison and the block is
+// built again without it, so the rest of the batch is still inserted.
+func (p *processor) insertClickHouseBatch(ctx context.Context, logs []*pendingLog) error {
+	existing, err := p.existingClickHouseIDs(ctx, logs)
+	if err != nil {
+		return err
+	}
+	for {
+		refused, err := p.sendClickHouseBatch(ctx, logs, existing)
+		if refused == nil {
+			return err
+		}
+		refused.err = &poisonError{err}
+		sinkFailures.WithLabelValues(sinkClickHouse).Inc()
+	}
+}
+
+// sendClickHouseBatch appends the writable logs that are not stored yet to a
+// new block and sends it. If a log cannot be appended, the block is dropped
+// and that log is returned along with the error.
+func (p *processor) sendClickHouseBatch(ctx context.Context, logs []*pendingLog, existing map[string]bool) (*pendingLog, error) {
+	batch, err := p.chConn.PrepareBatch(ctx,
+		`INSERT INTO logs (project_id, event_name, event_timestamp, log_id, searchable_keys, ttl_seconds)`)
+	if err != nil {
+		return nil, fmt.Errorf("prepare ClickHouse batch: %w", err)
+	}
+	inserted := 0
+	for _, l := range logs {
+		logID := l.entry.LogID.String()
+		if !l.writable() || existing[logID] {
+			continue
+		}
+		logPayload := l.entry.Payload
+		searchableKeys := logPayload.SearchableKeys
+		if searchableKeys == nil {
+			searchableKeys = map[string]string{}
+		}
+		err := batch.Append(l.entry.ProjectID, logPayload.Name, logPayload.Timestamp, logID,
+			searchableKeys, uint32(l.settings.CassandraTTL()))
+		if err != nil {
+			batch.Abort()
+			return l, fmt.Errorf("append to ClickHouse batch: %w", err)
+		}
+		inserted++
+	}
+	if inserted == 0 {
+		batch.Abort()
+		return nil, nil
+	}
+	if err := batch.Send(); err != nil {
+		return nil, fmt.Errorf("send ClickHouse batch: %w", err)
+	}
+	return nil, nil
+}
+
+// existingClickHouseIDs returns which of the logs' IDs are already stored in
+// ClickHouse.
+func (p *processor) existingClickHouseIDs(ctx context.Context, logs []*pendingLog) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	for start := 0; start < len(logs); start += existingIDsChunkSize {
+		chunk := logs[start:min(start+existingIDsChunkSize, len(logs))]
+
+		projectSet := make(map[string]bool)
+		var projects, ids []string
+		from, to := chunk[0].entry.Payload.Timestamp, chunk[0].entry.Payload.Timestamp
+		for _, l := range chunk {
+			if !projectSet[l.entry.ProjectID] {
+				projectSet[l.entry.ProjectID] = true
+				projects = append(projects, l.entry.ProjectID)
+			}
+			ids = append(ids, l.entry.LogID.String())
+			from = minTime(from, l.entry.Payload.Timestamp)
+			to = maxTime(to, l.entry.Payload.Timestamp)
+		}
+
+		rows, err := p.chConn.Query(ctx, `
+			SELECT toString(log_id) FROM logs
+			WHERE project_id IN (?) AND event_timestamp >= toDateTime(?) AND event_timestamp <= toDateTime(?)
+			AND log_id IN (?)`,
+			projects, from.Unix(), to.Unix(), ids)
+		if err != nil {
+			return nil, fmt.Errorf("look up existing ClickHouse logs: %w", err)
+		}
+		for rows.Next() {
+			var logID string
+			if err := rows.Scan(&logID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scan existing ClickHouse log: %w", err)
+			}
+			existing[logID] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("look up existing ClickHouse logs: %w", err)
+		}
+	}
+	return existing, nil
+}
+
+// deleteClickHouseLogs deletes the rows of the logs table that match where
+// with an ALTER TABLE ... DELETE mutation, which every ClickHouse version with
+// MergeTree supports, unlike lightweight DELETE. Mutations are applied in the
+// background, so the rows disappear shortly after this returns. backend-api's
+// project purge job deletes logs the same way.
+func deleteClickHouseLogs(ctx context.Context, conn clickhouse.Conn, where string, args ...any) error {
+	return conn.Exec(ctx, "ALTER TABLE logs DELETE WHERE "+where, args...)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -2,46 +2,49 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gocql/gocql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	// "github.com/segmentio/kafka-go"
 )
 
 func connectToCassandra() *gocql.Session {
 	cassandraHosts := strings.Split(os.Getenv("CASSANDRA_HOSTS"), ",")
 	if len(cassandraHosts) == 0 || cassandraHosts[0] == "" {
-		log.Fatal("CASSANDRA_HOSTS environment variable is not set")
+		fatal("CASSANDRA_HOSTS environment variable is not set")
 	}
 
 	var session *gocql.Session
 	var err error
 
 	for i := 0; i < maxRetries; i++ {
-		log.Printf("Connecting to Cassandra cluster at %v (attempt %d/%d)", cassandraHosts, i+1, maxRetries)
+		slog.Info("Connecting to Cassandra", "hosts", cassandraHosts, "attempt", i+1, "max_attempts", maxRetries)
 		cluster := gocql.NewCluster(cassandraHosts...)
 		cluster.Keyspace = "system"
 		session, err = cluster.CreateSession()
 		if err == nil {
-			log.Println("Successfully connected to Cassandra.")
+			slog.Info("Successfully connected to Cassandra")
 			return session
 		}
-		log.Printf("Cassandra connection failed: %v. Retrying in %v...", err, retryInterval)
+		slog.Warn("Cassandra connection failed, retrying", "backoff", retryInterval, "error", err)
 		time.Sleep(retryInterval)
 	}
-	log.Fatalf("Could not connect to Cassandra after %d attempts: %v", maxRetries, err)
+	fatal("Could not connect to Cassandra", "attempts", maxRetries, "error", err)
 	return nil
 }
 
 func connectToClickHouse() clickhouse.Conn {
 	clickhouseHost := os.Getenv("CLICKHOUSE_HOST")
 	if clickhouseHost == "" {
-		log.Fatal("CLICKHOUSE_HOST environment variable is not set")
+		fatal("CLICKHOUSE_HOST environment variable is not set")
 	}
 	clickhouseAddr := fmt.Sprintf("%s:9000", clickhouseHost)
 
@@ -49,7 +52,7 @@ func connectToClickHouse() clickhouse.Conn {
 	var err error
 
 	for i := 0; i < maxRetries; i++ {
-		log.Printf("Connecting to ClickHouse at %s (attempt %d/%d)", clickhouseAddr, i+1, maxRetries)
+		slog.Info("Connecting to ClickHouse", "addr", clickhouseAddr, "attempt", i+1, "max_attempts", maxRetries)
 		conn, err = clickhouse.Open(&clickhouse.Options{
 			Addr:        []string{clickhouseAddr},
 			Auth:        clickhouse.Auth{Database: "default"},
@@ -57,13 +60,47 @@ func connectToClickHouse() clickhouse.Conn {
 		})
 		if err == nil {
 			if err := conn.Ping(context.Background()); err == nil {
-				log.Println("Successfully connected to ClickHouse.")
+				slog.Info("Successfully connected to ClickHouse")
 				return conn
 			}
 		}
-		log.Printf("ClickHouse connection failed: %v. Retrying in %v...", err, retryInterval)
+		slog.Warn("ClickHouse connection failed, retrying", "backoff", retryInterval, "error", err)
 		time.Sleep(retryInterval)
 	}
-	log.Fatalf("Could not connect to ClickHouse after %d attempts: %v", maxRetries, err)
+	fatal("Could not connect to ClickHouse", "attempts", maxRetries, "error", err)
 	return nil
 }
+
+func connectToCockroachDB() *sql.DB {
+	cockroachDBURL := os.Getenv("COCKROACHDB_URL")
+	if cockroachDBURL == "" {
+		fatal("COCKROACHDB_URL environment variable is not set")
+	}
+
+	var db *sql.DB
+	var err error
+
+	for i := 0; i < maxRetries; i++ {
+		slog.Info("Connecting to CockroachDB", "attempt", i+1, "max_attempts", maxRetries)
+		db, err = sql.Open("pgx", cockroachDBURL)
+		if err == nil {
+			if err = db.Ping(); err == nil {
+				slog.Info("Successfully connected to CockroachDB")
+				return db
+			}
+		}
+		slog.Warn("CockroachDB connection failed, retrying", "backoff", retryInterval, "error", err)
+		time.Sleep(retryInterval)
+	}
+	fatal("Could not connect to CockroachDB", "attempts", maxRetries, "error", err)
+	return nil
+}
+
+// envInt reads a positive integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// dlqTopic receives messages that could not be processed. Each one carries
+// the original key and value unchanged, plus headers describing the failure.
+const dlqTopic = "log-events-dlq"
+
+func newDLQWriter(broker string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(broker),
+		Topic:                  dlqTopic,
+		Balancer:               &kafka.Hash{},
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// sendToDLQ publishes m to the dead-letter topic, retrying until it succeeds
+// or ctx is done, so the message's offset is never committed before it has
+// been preserved somewhere. The message's own headers are kept. It returns
+// false if ctx ended first.
+func (p *processor) sendToDLQ(ctx context.Context, m kafka.Message, reason error) bool {
+	headers := m.Headers
+	headers = withHeader(headers, "dlq-error", []byte(reason.Error()))
+	headers = withHeader(headers, "dlq-original-topic", []byte(m.Topic))
+	headers = withHeader(headers, "dlq-original-partition", []byte(strconv.Itoa(m.Partition)))
+	headers = withHeader(headers, "dlq-original-offset", []byte(strconv.FormatInt(m.Offset, 10)))
+	headers = withHeader(headers, "dlq-failed-at", []byte(time.Now().UTC().Format(time.RFC3339)))
+	dlqMsg := kafka.Message{
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: headers,
+	}
+
+	backoff := initialBackoff
+	for {
+		err := p.dlq.WriteMessages(ctx, dlqMsg)
+		if err == nil {
+			slog.Info("Sent message to dead-letter topic", "topic", dlqTopic, "partition", m.Partition, "offset", m.Offset, "request_id", headerValue(m, kafkaRequestIDHeader))
+			return true
+		}
+		slog.Warn("Failed to write message to dead-letter topic, retrying", "topic", dlqTopic, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
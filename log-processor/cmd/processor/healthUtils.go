@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gocql/gocql"
+	"github.com/segmentio/kafka-go"
+)
+
+// healthCheckTimeout bounds each dependency check of a readiness probe.
+const healthCheckTimeout = 2 * time.Second
+
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ConsumerGroupStatus struct {
+	GroupID string `json:"group_id"`
+	State   string `json:"state,omitempty"`
+	Members int    `json:"members"`
+	// Lag is the number of messages the group has not committed yet, over
+	// all partitions, as of LagMeasuredAt.
+	Lag           int64            `json:"lag"`
+	PartitionLag  map[string]int64 `json:"partition_lag,omitempty"`
+	LagMeasuredAt *time.Time       `json:"lag_measured_at,omitempty"`
+	LastFetchAt   *time.Time       `json:"last_fetch_at,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status        string               `json:"status"`
+	Dependencies  []DependencyStatus   `json:"dependencies"`
+	ConsumerGroup *ConsumerGroupStatus `json:"consumer_group,omitempty"`
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthChecker answers the processor's liveness and readiness probes.
+type healthChecker struct {
+	session *gocql.Session
+	chConn  clickhouse.Conn
+	db      *sql.DB
+	broker  string
+	reader  *kafka.Reader
+	lag     *lagMonitor
+	proc    *processor
+}
+
+func (h *healthChecker) liveHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// readyHandler checks Cassandra, ClickHouse, CockroachDB and Kafka, and
+// reports the state of the consumer group. It answers 503 if a dependency is
+// down or the group cannot be described.
+func (h *healthChecker) readyHandler(w http.ResponseWriter, r *http.Request) {
+	var group ConsumerGroupStatus
+	checks := []dependencyCheck{
+		{"cassandra", func(ctx context.Context) error {
+			return h.session.Query(`SELECT release_version FROM system.local`).WithContext(ctx).Exec()
+		}},
+		{"clickhouse", func(ctx context.Context) error { return h.chConn.Ping(ctx) }},
+		{"cockroachdb", func(ctx context.Context) error { return h.db.PingContext(ctx) }},
+		{"kafka:" + h.broker, func(ctx context.Context) error { return pingKafkaBroker(ctx, h.broker) }},
+		{"consumer_group", func(ctx context.Context) error {
+			var err error
+			group, err = h.consumerGroupStatus(ctx)
+			return err
+		}},
+	}
+
+	resp := runDependencyChecks(r.Context(), checks)
+	resp.ConsumerGroup = &group
+	status := http.StatusOK
+	if resp.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, status, resp)
+}
+
+// consumerGroupStatus describes the processors' consumer group. A group that
+// is Empty or Dead has no live members, which means this processor has not
+// joined it.
+func (h *healthChecker) consumerGroupStatus(ctx context.Context) (ConsumerGroupStatus, error) {
+	groupID := h.reader.Config().GroupID
+	status := ConsumerGroupStatus{GroupID: groupID}
+	if lag := h.lag.Last(); !lag.MeasuredAt.IsZero() {
+		status.Lag = lag.Total
+		status.PartitionLag = make(map[string]int64, len(lag.ByPartition))
+		for partition, n := range lag.ByPartition {
+			status.PartitionLag[strconv.Itoa(partition)] = n
+		}
+		t := lag.MeasuredAt.UTC()
+		status.LagMeasuredAt = &t
+	}
+	if last := h.proc.lastFetch.Load(); last != 0 {
+		t := time.Unix(0, last).UTC()
+		status.LastFetchAt = &t
+	}
+
+	client := &kafka.Client{Addr: kafka.TCP(h.broker)}
+	resp, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{groupID}})
+	if err != nil {
+		return status, fmt.Errorf("describe group: %w", err)
+	}
+	if len(resp.Groups) == 0 {
+		return status, fmt.Errorf("group %s not found", groupID)
+	}
+	g := resp.Groups[0]
+	if g.Error != nil {
+		return status, fmt.Errorf("describe group: %w", g.Error)
+	}
+	status.State = g.GroupState
+	status.Members = len(g.Members)
+	if g.GroupState == "Empty" || g.GroupState == "Dead" {
+		return status, fmt.Errorf("group is %s", g.GroupState)
+	}
+	return status, nil
+}
+
+// runDependencyChecks runs the checks concurrently, each with its own timeout.
+func runDependencyChecks(ctx context.Context, checks []dependencyCheck) ReadinessResponse {
+	resp := ReadinessResponse{Status: "ready", Dependencies: make([]DependencyStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c dependencyCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(checkCtx)
+			dep := DependencyStatus{
+				Name:      c.name,
+				Status:    "up",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				dep.Status = "down"
+				dep.Error = err.Error()
+			}
+			resp.Dependencies[i] = dep
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, dep := range resp.Dependencies {
+		if dep.Status != "up" {
+			resp.Status = "not ready"
+		}
+	}
+	return resp
+}
+
+// pingKafkaBroker connects to a broker and asks it for the cluster's brokers.
+func pingKafkaBroker(ctx context.Context, broker string) error {
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Brokers(); err != nil {
+		return fmt.Errorf("list brokers: %w", err)
+	}
+	return nil
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -3,22 +3,27 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
-
+	"log/slog"
+	"strings"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gocql/gocql"
 )
 
+// clickhouseTTLExpr expires a row ttl_seconds after it was received, the same
+// way Cassandra's "USING TTL" counts from the write. Rows with ttl_seconds = 0
+// are kept indefinitely.
+const clickhouseTTLExpr = `if(ttl_seconds = 0, toDateTime('2100-01-01 00:00:00'), received_at + toIntervalSecond(ttl_seconds))`
+
 func initCassandra(session *gocql.Session) {
-	log.Println("Initializing Cassandra schema...")
+	slog.Info("Initializing Cassandra schema")
 	// Create Keyspace
 	err := session.Query(fmt.Sprintf(`
 		CREATE KEYSPACE IF NOT EXISTS %s
 		WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '3'}
 	`, cassandraKeyspace)).Exec()
 	if err != nil {
-		log.Fatalf("Failed to create Cassandra keyspace: %v", err)
+		fatal("Failed to create Cassandra keyspace", "error", err)
 	}
 
 	// Create Table
@@ -27,18 +32,46 @@ func initCassandra(session *gocql.Session) {
 			project_id text,
 			event_timestamp timestamp,
 			log_id timeuuid,
+			event_name text,
 			payload text,
+			searchable_keys map<text, text>,
 			PRIMARY KEY (project_id, event_timestamp, log_id)
 		) WITH CLUSTERING ORDER BY (event_timestamp DESC, log_id DESC)
 	`, cassandraKeyspace, cassandraTable)).Exec()
 	if err != nil {
-		log.Fatalf("Failed to create Cassandra table: %v", err)
+		fatal("Failed to create Cassandra table", "error", err)
+	}
+
+	// Tables created before event_name was stored lack the column.
+	err = session.Query(fmt.Sprintf(`ALTER TABLE %s.%s ADD IF NOT EXISTS event_name text`, cassandraKeyspace, cassandraTable)).Exec()
+	if err != nil {
+		fatal("Failed to add event_name column to Cassandra table", "error", err)
+	}
+
+	// searchable_keys lets reconciliation rebuild a ClickHouse row from Cassandra.
+	err = session.Query(fmt.Sprintf(`ALTER TABLE %s.%s ADD IF NOT EXISTS searchable_keys map<text, text>`, cassandraKeyspace, cassandraTable)).Exec()
+	if err != nil {
+		fatal("Failed to add searchable_keys column to Cassandra table", "error", err)
+	}
+
+	// Create the lookup table that maps a log ID to its position in the logs
+	// table, so a single log can be read without scanning the partition.
+	err = session.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.%s (
+			project_id text,
+			log_id timeuuid,
+			event_timestamp timestamp,
+			PRIMARY KEY ((project_id, log_id))
+		)
+	`, cassandraKeyspace, cassandraLookupTable)).Exec()
+	if err != nil {
+		fatal("Failed to create Cassandra lookup table", "error", err)
 	}
-	log.Println("Cassandra schema initialized successfully.")
+	slog.Info("Cassandra schema initialized successfully")
 }
 
 func initClickHouse(conn clickhouse.Conn) {
-	log.Println("Initializing ClickHouse schema...")
+	slog.Info("Initializing ClickHouse schema")
 	err := conn.Exec(context.Background(), fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
 			project_id String,
@@ -46,14 +79,37 @@ func initClickHouse(conn clickhouse.Conn) {
 			event_timestamp DateTime,
 			log_id UUID,
 			searchable_keys Map(String, String),
-			received_at DateTime DEFAULT now()
+			received_at DateTime DEFAULT now(),
+			ttl_seconds UInt32 DEFAULT 0
 		) ENGINE = MergeTree()
 		PARTITION BY toYYYYMM(event_timestamp)
 		ORDER BY (project_id, event_name, event_timestamp)
-	`, clickhouseTable))
+		TTL %s
+	`, clickhouseTable, clickhouseTTLExpr))
 
 	if err != nil {
-		log.Fatalf("Failed to create ClickHouse table: %v", err)
+		fatal("Failed to create ClickHouse table", "error", err)
+	}
+
+	// Tables created before retention was enforced have neither the
+	// ttl_seconds column nor a TTL clause.
+	err = conn.Exec(context.Background(), fmt.Sprintf(
+		`ALTER TABLE %s ADD COLUMN IF NOT EXISTS ttl_seconds UInt32 DEFAULT 0`, clickhouseTable))
+	if err != nil {
+		fatal("Failed to add ttl_seconds column to ClickHouse table", "error", err)
+	}
+	var engineFull string
+	err = conn.QueryRow(context.Background(),
+		`SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?`, clickhouseTable).Scan(&engineFull)
+	if err != nil {
+		fatal("Failed to inspect ClickHouse table", "error", err)
+	}
+	if !strings.Contains(engineFull, "TTL") {
+		slog.Info("Adding TTL clause to ClickHouse table")
+		err = conn.Exec(context.Background(), fmt.Sprintf(`ALTER TABLE %s MODIFY TTL %s`, clickhouseTable, clickhouseTTLExpr))
+		if err != nil {
+			fatal("Failed to add TTL to ClickHouse table", "error", err)
+		}
 	}
-	log.Println("ClickHouse schema initialized successfully.")
+	slog.Info("ClickHouse schema initialized successfully")
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// lagPollInterval is how often the consumer group's lag is measured.
+const lagPollInterval = 15 * time.Second
+
+var consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "processor_kafka_consumer_lag",
+	Help: "Messages in a partition not yet committed by the processors' consumer group, by partition.",
+}, []string{"partition"})
+
+// ConsumerLag is the consumer group's lag as of its last measurement.
+type ConsumerLag struct {
+	Total       int64
+	ByPartition map[int]int64
+	MeasuredAt  time.Time
+	Err         error
+}
+
+// lagMonitor measures the consumer group's lag per partition as the end
+// offset of each partition minus the offset the group committed there. It
+// asks the broker rather than the reader, whose Stats reset on every call
+// and only hold one partition's lag in a consumer group.
+type lagMonitor struct {
+	client  *kafka.Client
+	groupID string
+	topic   string
+
+	mu   sync.RWMutex
+	last ConsumerLag
+}
+
+func newLagMonitor(broker, groupID, topic string) *lagMonitor {
+	return &lagMonitor{client: &kafka.Client{Addr: kafka.TCP(broker)}, groupID: groupID, topic: topic}
+}
+
+// Start measures the lag every lagPollInterval until ctx is done.
+func (m *lagMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(lagPollInterval)
+		defer ticker.Stop()
+		for {
+			m.poll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Last returns the latest measurement.
+func (m *lagMonitor) Last() ConsumerLag {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.last
+}
+
+func (m *lagMonitor) poll(ctx context.Context) {
+	pollCtx, cancel := context.WithTimeout(ctx, lagPollInterval)
+	defer cancel()
+	byPartition, err := m.measure(pollCtx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("Failed to measure consumer lag", "group_id", m.groupID, "error", err)
+		}
+		m.mu.Lock()
+		m.last.Err = err
+		m.mu.Unlock()
+		return
+	}
+
+	lag := ConsumerLag{ByPartition: byPartition, MeasuredAt: time.Now()}
+	for partition, n := range byPartition {
+		lag.Total += n
+		consumerLag.WithLabelValues(strconv.Itoa(partition)).Set(float64(n))
+	}
+	m.mu.Lock()
+	m.last = lag
+	m.mu.Unlock()
+}
+
+// measure returns the lag of every partition of the topic.
+func (m *lagMonitor) measure(ctx context.Context) (map[int]int64, error) {
+	meta, err := m.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{m.topic}})
+	if err != nil {
+		return nil, fmt.Errorf("fetch metadata: %w", err)
+	}
+	if len(meta.Topics) == 0 {
+		return nil, fmt.Errorf("topic %s not found", m.topic)
+	}
+	if meta.Topics[0].Error != nil {
+		return nil, fmt.Errorf("fetch metadata: %w", meta.Topics[0].Error)
+	}
+	var partitions []int
+	var offsetRequests []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+		offsetRequests = append(offsetRequests, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+
+	committed, err := m.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: m.groupID,
+		Topics:  map[string][]int{m.topic: partitions},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch committed offsets: %w", err)
+	}
+	if committed.Error != nil {
+		return nil, fmt.Errorf("fetch committed offsets: %w", committed.Error)
+	}
+	offsets, err := m.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{m.topic: offsetRequests},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list offsets: %w", err)
+	}
+
+	ends := make(map[int]kafka.PartitionOffsets)
+	for _, p := range offsets.Topics[m.topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("list offsets of partition %d: %w", p.Partition, p.Error)
+		}
+		ends[p.Partition] = p
+	}
+	lag := make(map[int]int64, len(partitions))
+	for _, p := range committed.Topics[m.topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("fetch committed offset of partition %d: %w", p.Partition, p.Error)
+		}
+		end, ok := ends[p.Partition]
+		if !ok {
+			continue
+		}
+		lag[p.Partition] = partitionLag(p.CommittedOffset, end.FirstOffset, end.LastOffset)
+	}
+	return lag, nil
+}
+
+// partitionLag is how many messages of a partition holding [first, last) the
+// group has yet to commit. A negative committed offset means the group has
+// not committed there yet; a committed offset below first was deleted by
+// retention, and those messages can no longer be consumed.
+func partitionLag(committed, first, last int64) int64 {
+	if committed < first {
+		committed = first
+	}
+	return max(last-committed, 0)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestPartitionLag(t *testing.T) {
+	tests := []struct {
+		name                   string
+		committed, first, last int64
+		want                   int64
+	}{
+		{"caught up", 100, 0, 100, 0},
+		{"behind", 40, 0, 100, 60},
+		{"nothing committed yet", -1, 0, 100, 100},
+		{"nothing committed on a trimmed partition", -1, 70, 100, 30},
+		{"committed offset deleted by retention", 20, 70, 100, 30},
+		{"empty partition", -1, 0, 0, 0},
+		{"committed past the end", 120, 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partitionLag(tt.committed, tt.first, tt.last); got != tt.want {
+				t.Errorf("partitionLag(%d, %d, %d) = %d, want %d", tt.committed, tt.first, tt.last, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/segmentio/kafka-go"
+)
+
+// logIDHeader carries a log's ID on messages sent to the dead-letter topic,
+// so a replayed message keeps the ID it was first written with.
+const logIDHeader = "log-id"
+
+// deterministicLogID returns a time-based UUID for ts whose clock sequence and
+// node are derived from seed. The same timestamp and seed always give the same
+// ID, which makes writing a log again an overwrite instead of a duplicate.
+func deterministicLogID(ts time.Time, seed string) gocql.UUID {
+	id := gocql.UUIDFromTime(ts)
+	sum := sha256.Sum256([]byte(seed))
+	copy(id[8:], sum[:8])
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return id
+}
+
+// messageLogID returns the ID of the log in m: the one backend-api assigned
+// at ingestion, or the one recorded in its log-id header. Messages produced
+// before IDs were assigned at ingestion get one derived from their position
+// in Kafka, which stays the same when the message is redelivered.
+func messageLogID(m kafka.Message, assigned string, ts time.Time) gocql.UUID {
+	if id, ok := parseTimeUUID(assigned); ok {
+		return id
+	}
+	for _, h := range m.Headers {
+		if h.Key != logIDHeader {
+			continue
+		}
+		if id, ok := parseTimeUUID(string(h.Value)); ok {
+			return id
+		}
+	}
+	return deterministicLogID(ts, fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset))
+}
+
+// parseTimeUUID parses s as a version 1 UUID, the only kind a timeuuid
+// column accepts.
+func parseTimeUUID(s string) (gocql.UUID, bool) {
+	id, err := gocql.ParseUUID(s)
+	if err != nil || id.Version() != 1 {
+		return gocql.UUID{}, false
+	}
+	return id, true
+}
+
+// withHeader returns headers with key set to value, replacing any existing
+// header of that name.
+func withHeader(headers []kafka.Header, key string, value []byte) []kafka.Header {
+	out := make([]kafka.Header, 0, len(headers)+1)
+	for _, h := range headers {
+		if h.Key != key {
+			out = append(out, h)
+		}
+	}
+	return append(out, kafka.Header{Key: key, Value: value})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestDeterministicLogID(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 535897900, time.UTC)
+	tests := []struct {
+		name     string
+		ts1, ts2 time.Time
+		seed1    string
+		seed2    string
+		wantSame bool
+	}{
+		{"same timestamp and seed", ts, ts, "logs/0/42", "logs/0/42", true},
+		{"other offset", ts, ts, "logs/0/42", "logs/0/43", false},
+		{"other partition", ts, ts, "logs/0/42", "logs/1/42", false},
+		{"other timestamp", ts, ts.Add(time.Microsecond), "logs/0/42", "logs/0/42", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id1 := deterministicLogID(tt.ts1, tt.seed1)
+			id2 := deterministicLogID(tt.ts2, tt.seed2)
+			if (id1 == id2) != tt.wantSame {
+				t.Errorf("deterministicLogID() = %s and %s, want same = %v", id1, id2, tt.wantSame)
+			}
+			for _, id := range []gocql.UUID{id1, id2} {
+				if id.Version() != 1 || id.Variant() != gocql.VariantIETF {
+					t.Errorf("%s has version %d and variant %d, want a version 1 RFC 4122 UUID", id, id.Version(), id.Variant())
+				}
+			}
+			if got := id1.Time(); !got.Equal(tt.ts1.Truncate(100 * time.Nanosecond)) {
+				t.Errorf("Time() = %v, want %v", got, tt.ts1)
+			}
+		})
+	}
+}
+
+func TestMessageLogID(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+	assigned := gocql.UUIDFromTime(ts.Add(-time.Hour))
+	replayed := gocql.UUIDFromTime(ts.Add(-2 * time.Hour))
+	random, _ := gocql.RandomUUID()
+	msg := kafka.Message{Topic: "logs", Partition: 3, Offset: 1234}
+	derived := deterministicLogID(ts, "logs/3/1234")
+
+	tests := []struct {
+		name     string
+		assigned string
+		headers  []kafka.Header
+		want     gocql.UUID
+	}{
+		{"assigned at ingestion", assigned.String(), nil, assigned},
+		{"assigned wins over the header", assigned.String(), []kafka.Header{{Key: logIDHeader, Value: []byte(replayed.String())}}, assigned},
+		{"from the dead-letter header", "", []kafka.Header{{Key: logIDHeader, Value: []byte(replayed.String())}}, replayed},
+		{"derived from the position", "", nil, derived},
+		{"assigned ID that is not a timeuuid", random.String(), nil, derived},
+		{"malformed assigned ID", "not-a-uuid", nil, derived},
+		{"malformed header", "", []kafka.Header{{Key: logIDHeader, Value: []byte("nope")}}, derived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := msg
+			m.Headers = tt.headers
+			if got := messageLogID(m, tt.assigned, ts); got != tt.want {
+				t.Errorf("messageLogID() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
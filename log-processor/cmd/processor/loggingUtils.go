@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaRequestIDHeader carries the ID of the backend-api request that produced
+// a message.
+const kafkaRequestIDHeader = "request-id"
+
+// newLoggerFromEnv builds the process logger. LOG_LEVEL is one of debug, info
+// (the default), warn or error; LOG_FORMAT is json (the default) or text.
+func newLoggerFromEnv() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// headerValue returns the value of m's header key, or "" if it has none.
+func headerValue(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// messageLogger returns a logger that tags every line with the message's
+// position in Kafka and the request that produced it.
+func messageLogger(l *pendingLog) *slog.Logger {
+	logger := slog.With(
+		"partition", l.msg.Partition,
+		"offset", l.msg.Offset,
+		"request_id", headerValue(l.msg, kafkaRequestIDHeader),
+	)
+	if l.entry != nil {
+		logger = logger.With("project_id", l.entry.ProjectID, "log_id", l.entry.LogID.String())
+	}
+	return logger
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	// "github.com/ClickHouse/clickhouse-go/v2"
@@ -20,11 +22,19 @@ const (
 	kafkaTopic        = "log-events"
 	maxRetries        = 10
 	retryInterval     = 5 * time.Second
+
+	// defaultShutdownTimeout bounds how long in-flight batches may take to be
+	// written and committed after a shutdown signal.
+	defaultShutdownTimeout = 20 * time.Second
+
+	// cassandraLookupTable maps (project_id, log_id) to the log's event_timestamp.
+	cassandraLookupTable = "logs_by_id"
 )
 
 // KafkaLogMessage defines the structure of the message received from Kafka.
 type KafkaLogMessage struct {
 	ProjectID string          `json:"project_id"`
+	LogID     string          `json:"log_id"`
 	Payload   json.RawMessage `json:"payload"`
 }
 
@@ -37,7 +47,8 @@ type LogPayload struct {
 }
 
 func main() {
-	log.Println("Starting Log Processor Service...")
+	slog.SetDefault(newLoggerFromEnv())
+	slog.Info("Starting Log Processor Service")
 
 	// --- Cassandra Setup ---
 	session := connectToCassandra()
@@ -48,24 +59,35 @@ func main() {
 	cluster.Keyspace = cassandraKeyspace
 	session, err := cluster.CreateSession()
 	if err != nil {
-		log.Fatalf("Failed to connect to Cassandra with keyspace: %v", err)
+		fatal("Failed to connect to Cassandra with keyspace", "error", err)
 	}
 	defer session.Close()
 
-	log.Println("Cassandra connection and schema verified.")
+	slog.Info("Cassandra connection and schema verified")
 
 	// --- ClickHouse Setup ---
 	chConn := connectToClickHouse()
 	defer chConn.Close()
 	initClickHouse(chConn)
-	log.Println("ClickHouse connection and schema verified.")
+	slog.Info("ClickHouse connection and schema verified")
+
+	// --- CockroachDB Setup ---
+	db := connectToCockroachDB()
+	defer db.Close()
+	projectSettings := newProjectSettingsCache(db)
+
+	// "processor reconcile ..." compares and repairs the stores, then exits.
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		runReconcile(session, chConn, projectSettings, os.Args[2:])
+		return
+	}
 
 	// --- Kafka Setup ---
 	kafkaBroker := os.Getenv("KAFKA_BROKER")
 	if kafkaBroker == "" {
-		log.Fatal("KAFKA_BROKER environment variable is not set.")
+		fatal("KAFKA_BROKER environment variable is not set")
 	}
-	log.Printf("Connecting to Kafka broker at %s", kafkaBroker)
+	slog.Info("Connecting to Kafka", "broker", kafkaBroker)
 	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  []string{kafkaBroker},
 		Topic:    kafkaTopic,
@@ -74,49 +96,53 @@ func main() {
 		MaxBytes: 10e6, // 10MB
 	})
 	defer kafkaReader.Close()
-	log.Println("Kafka reader created.")
+	slog.Info("Kafka reader created")
+	lag := newLagMonitor(kafkaBroker, kafkaReader.Config().GroupID, kafkaTopic)
+
+	dlqWriter := newDLQWriter(kafkaBroker)
+	defer dlqWriter.Close()
+
+	p := &processor{
+		session:         session,
+		chConn:          chConn,
+		projectSettings: projectSettings,
+		dlq:             dlqWriter,
+		batchSize:       envInt("CLICKHOUSE_BATCH_SIZE", defaultClickHouseBatchSize),
+		flushInterval:   time.Duration(envInt("CLICKHOUSE_FLUSH_INTERVAL_MS", int(defaultClickHouseFlushInterval/time.Millisecond))) * time.Millisecond,
+
+		cassandraWorkers:   max(envInt("CASSANDRA_WRITE_WORKERS", defaultCassandraWriteWorkers), 1),
+		cassandraBatchSize: max(envInt("CASSANDRA_BATCH_SIZE", defaultCassandraBatchSize), 1),
+		maxInFlightBatches: max(envInt("MAX_INFLIGHT_BATCHES", defaultMaxInFlightBatches), 0),
+	}
+	slog.Info("Processor configured", "batch_size", p.batchSize, "flush_interval", p.flushInterval,
+		"cassandra_workers", p.cassandraWorkers, "max_inflight_batches", p.maxInFlightBatches)
+
+	// --- Metrics and Health Checks ---
+	health := &healthChecker{session: session, chConn: chConn, db: db, broker: kafkaBroker, reader: kafkaReader, lag: lag, proc: p}
+	statusServer := startStatusServer(envInt("METRICS_PORT", defaultMetricsPort), health)
 
 	// --- Main Processing Loop ---
-	log.Println("Starting log processing loop...")
-	for {
-		m, err := kafkaReader.ReadMessage(context.Background())
-		if err != nil {
-			log.Printf("Error reading message from Kafka: %v", err)
-			continue
-		}
-
-		var kafkaMsg KafkaLogMessage
-		if err := json.Unmarshal(m.Value, &kafkaMsg); err != nil {
-			log.Printf("Error unmarshalling Kafka message: %v. Message: %s", err, string(m.Value))
-			continue
-		}
-
-		var logPayload LogPayload
-		if err := json.Unmarshal(kafkaMsg.Payload, &logPayload); err != nil {
-			log.Printf("Error unmarshalling log payload: %v. Payload: %s", err, string(kafkaMsg.Payload))
-			continue
-		}
-
-		logID := gocql.TimeUUID()
-
-		// Insert into Cassandra
-		if err := session.Query(
-			`INSERT INTO logs (project_id, event_timestamp, log_id, payload) VALUES (?, ?, ?, ?)`,
-			kafkaMsg.ProjectID, logPayload.Timestamp, logID, string(logPayload.FullPayload),
-		).Exec(); err != nil {
-			log.Printf("Failed to insert log into Cassandra: %v", err)
-			continue
-		}
-
-		// Insert into ClickHouse
-		if err := chConn.Exec(context.Background(),
-			`INSERT INTO logs (project_id, event_name, event_timestamp, log_id, searchable_keys) VALUES (?, ?, ?, ?, ?)`,
-			kafkaMsg.ProjectID, logPayload.Name, logPayload.Timestamp, logID.String(), logPayload.SearchableKeys,
-		); err != nil {
-			log.Printf("Failed to insert log into ClickHouse: %v", err)
-			continue
-		}
-
-		log.Printf("Processed log for project %s with ID %s", kafkaMsg.ProjectID, logID)
+	// A shutdown signal stops fetching; the batches already read are still
+	// written and committed unless that takes longer than the shutdown timeout.
+	stop, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	lag.Start(stop)
+	ctx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+	shutdownTimeout := time.Duration(envInt("SHUTDOWN_TIMEOUT_SECONDS", int(defaultShutdownTimeout/time.Second))) * time.Second
+	go func() {
+		<-stop.Done()
+		slog.Info("Shutting down, finishing in-flight batches", "timeout", shutdownTimeout)
+		time.AfterFunc(shutdownTimeout, cancelWrites)
+	}()
+
+	slog.Info("Starting log processing loop")
+	p.run(stop, ctx, kafkaReader)
+	if ctx.Err() != nil {
+		slog.Warn("Shutdown deadline exceeded; uncommitted messages will be redelivered")
 	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	statusServer.Shutdown(shutdownCtx)
+	slog.Info("Log processor stopped")
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// defaultMetricsPort serves /metrics and the health probes unless
+	// METRICS_PORT says otherwise.
+	defaultMetricsPort = 9100
+	// defaultMetricsMaxProjects bounds how many projects get their own label
+	// value; later projects are counted under otherProjectLabel.
+	defaultMetricsMaxProjects = 50
+	otherProjectLabel         = "other"
+
+	sinkCassandra  = "cassandra"
+	sinkClickHouse = "clickhouse"
+)
+
+var (
+	messagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "processor_messages_total",
+		Help: "Kafka messages committed, by outcome: stored, dropped, duplicate or dead_lettered.",
+	}, []string{"outcome"})
+	sinkWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "processor_sink_logs_written_total",
+		Help: "Logs written to a sink.",
+	}, []string{"sink"})
+	sinkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "processor_sink_logs_failed_total",
+		Help: "Logs a sink refused as invalid, which are sent to the dead-letter topic.",
+	}, []string{"sink"})
+	sinkWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "processor_sink_write_duration_seconds",
+		Help:    "Latency of a single write attempt: one Cassandra chunk or one ClickHouse batch.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"sink"})
+	logsStored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "processor_logs_stored_total",
+		Help: "Logs stored in both sinks, by project.",
+	}, []string{"project"})
+
+	projectLabels = newProjectLabeler(metricsMaxProjectsFromEnv())
+)
+
+// metricsMaxProjectsFromEnv reads METRICS_MAX_PROJECTS. 0 is allowed and
+// counts every project under otherProjectLabel; unset or invalid values fall
+// back to defaultMetricsMaxProjects.
+func metricsMaxProjectsFromEnv() int {
+	if v, err := strconv.Atoi(os.Getenv("METRICS_MAX_PROJECTS")); err == nil && v >= 0 {
+		return v
+	}
+	return defaultMetricsMaxProjects
+}
+
+// startStatusServer serves /metrics and the health probes on port in the
+// background.
+func startStatusServer(port int, health *healthChecker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health/live", health.liveHandler)
+	mux.HandleFunc("/health/ready", health.readyHandler)
+	srv := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+	go func() {
+		slog.Info("Serving metrics and health checks", "port", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Status server failed", "error", err)
+		}
+	}()
+	return srv
+}
+
+// observeWrite records the latency of one write attempt to sink.
+func observeWrite(sink string, start time.Time) {
+	sinkWriteDuration.WithLabelValues(sink).Observe(time.Since(start).Seconds())
+}
+
+// projectLabeler hands out project label values for the first max projects
+// it sees and otherProjectLabel for every project after that, which keeps the
+// number of time series bounded however many projects exist.
+type projectLabeler struct {
+	max   int
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+func newProjectLabeler(max int) *projectLabeler {
+	return &projectLabeler{max: max, known: make(map[string]bool)}
+}
+
+func (l *projectLabeler) Label(projectID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.known[projectID] {
+		return projectID
+	}
+	if len(l.known) < l.max {
+		l.known[projectID] = true
+		return projectID
+	}
+	return otherProjectLabel
+}
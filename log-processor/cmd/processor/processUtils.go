@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gocql/gocql"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	initialBackoff = 200 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+
+	defaultClickHouseBatchSize     = 5000
+	defaultClickHouseFlushInterval = time.Second
+	defaultCassandraWriteWorkers   = 16
+	defaultCassandraBatchSize      = 50
+	defaultMaxInFlightBatches      = 2
+)
+
+// The range of ClickHouse's DateTime type.
+var (
+	minEventTimestamp = time.Unix(0, 0)
+	maxEventTimestamp = time.Date(2106, 2, 7, 6, 28, 15, 0, time.UTC)
+)
+
+// processor consumes log messages from Kafka and writes them to Cassandra
+// and ClickHouse.
+type processor struct {
+	session         *gocql.Session
+	chConn          clickhouse.Conn
+	projectSettings *projectSettingsCache
+	dlq             *kafka.Writer
+
+	// batchSize and flushInterval bound a batch of messages.
+	batchSize     int
+	flushInterval time.Duration
+	// cassandraWorkers goroutines write a batch to Cassandra, each owning a
+	// share of the projects; cassandraBatchSize bounds one unlogged batch.
+	cassandraWorkers   int
+	cassandraBatchSize int
+	// maxInFlightBatches bounds how many full batches may wait for the
+	// writer before the reader stops fetching.
+	maxInFlightBatches int
+
+	// lastFetch is when the last message was fetched, in Unix nanoseconds.
+	lastFetch atomic.Int64
+}
+
+// decodedLog is a Kafka message that was successfully decoded.
+type decodedLog struct {
+	ProjectID string
+	LogID     gocql.UUID
+	Payload   LogPayload
+}
+
+// pendingLog tracks one message through a batch.
+type pendingLog struct {
+	msg      kafka.Message
+	entry    *decodedLog
+	settings ProjectSettings
+	// dropped logs belong to unknown projects and are committed unwritten.
+	dropped bool
+	// duplicate logs repeat the ID of an earlier log in the same batch.
+	duplicate bool
+	// err sends the message to the dead-letter topic. It is only set for
+	// poison messages; transient errors are retried until they pass.
+	err error
+}
+
+func (l *pendingLog) writable() bool {
+	return l.err == nil && !l.dropped && !l.duplicate
+}
+
+// pendingBatch is a run of consecutive messages that are written and
+// committed together.
+type pendingBatch struct {
+	logs    []*pendingLog
+	started time.Time
+}
+
+// poisonError marks a message that can never be processed, so retrying it
+// is pointless.
+type poisonError struct {
+	err error
+}
+
+func (e *poisonError) Error() string { return e.err.Error() }
+func (e *poisonError) Unwrap() error { return e.err }
+
+// run fetches messages until stop is done. Messages are decoded and collected
+// into batches of p.batchSize, or whatever arrived within p.flushInterval.
+// Full batches are queued to a single writer goroutine, so the next batch is
+// read while the previous one is written; once p.maxInFlightBatches are
+// queued the reader blocks. The writer handles batches strictly in order and
+// commits each batch's offsets only after it has been written to both stores
+// (or handed to the dead-letter topic), so commits never skip ahead of
+// unwritten logs in any Kafka partition.
+//
+// When stop is done, fetching stops, the partial batch is queued as well and
+// run returns once every queued batch is written and committed. Writes use
+// ctx, whose cancellation abandons the remaining batches uncommitted.
+func (p *processor) run(stop, ctx context.Context, reader *kafka.Reader) {
+	msgs := make(chan kafka.Message)
+	go fetchMessages(stop, reader, msgs)
+
+	batches := make(chan *pendingBatch, p.maxInFlightBatches)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for batch := range batches {
+			if !p.writeBatch(ctx, reader, batch) {
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(batches)
+		<-writerDone
+	}()
+
+	ticker := time.NewTicker(p.flushInterval / 4)
+	defer ticker.Stop()
+
+	batch := &pendingBatch{}
+	enqueue := func() bool {
+		select {
+		case batches <- batch:
+			batch = &pendingBatch{}
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				if len(batch.logs) > 0 {
+					enqueue()
+				}
+				return
+			}
+			p.lastFetch.Store(time.Now().UnixNano())
+			if len(batch.logs) == 0 {
+				batch.started = time.Now()
+			}
+			l := &pendingLog{msg: m}
+			l.entry, l.err = decodeMessage(m)
+			batch.logs = append(batch.logs, l)
+			if len(batch.logs) >= p.batchSize && !enqueue() {
+				return
+			}
+		case <-ticker.C:
+			if len(batch.logs) > 0 && time.Since(batch.started) >= p.flushInterval && !enqueue() {
+				return
+			}
+		}
+	}
+}
+
+// fetchMessages feeds messages from reader into msgs until ctx is done.
+func fetchMessages(ctx context.Context, reader *kafka.Reader, msgs chan<- kafka.Message) {
+	defer close(msgs)
+	for {
+		m, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to fetch message from Kafka", "error", err)
+			continue
+		}
+		select {
+		case msgs <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeBatch writes a batch to Cassandra and ClickHouse, sends the poison
+// messages to the dead-letter topic and commits the batch's offsets. It returns
+// false if ctx ended first, in which case nothing is committed.
+func (p *processor) writeBatch(ctx context.Context, reader *kafka.Reader, batch *pendingBatch) bool {
+	markDuplicates(batch)
+	if !p.resolveSettings(ctx, batch) {
+		return false
+	}
+	if !p.writeCassandra(ctx, batch) {
+		return false
+	}
+
+	var rows []*pendingLog
+	for _, l := range batch.logs {
+		if l.writable() {
+			rows = append(rows, l)
+		}
+	}
+	if len(rows) > 0 {
+		// The rows are already in Cassandra, so keep trying until ClickHouse
+		// has them too rather than leave logs that search cannot find.
+		err := retryUntilDone(ctx, func() error {
+			defer observeWrite(sinkClickHouse, time.Now())
+			return p.insertClickHouseBatch(ctx, rows)
+		})
+		if ctx.Err() != nil {
+			return false
+		}
+		inserted := 0
+		for _, l := range rows {
+			if !l.writable() {
+				// Refused by ClickHouse on its own and already counted.
+				continue
+			}
+			if err != nil {
+				sinkFailures.WithLabelValues(sinkClickHouse).Inc()
+				l.err = err
+				continue
+			}
+			inserted++
+		}
+		if err != nil {
+			slog.Error("Failed to insert batch into ClickHouse", "logs", len(rows), "error", err)
+		}
+		sinkWrites.WithLabelValues(sinkClickHouse).Add(float64(inserted))
+	}
+
+	written := 0
+	for _, l := range batch.logs {
+		if l.err == nil {
+			if l.writable() {
+				written++
+			}
+			continue
+		}
+		messageLogger(l).Error("Failed to process message", "error", l.err)
+		dlqMsg := l.msg
+		if l.entry != nil {
+			dlqMsg.Headers = withHeader(dlqMsg.Headers, logIDHeader, []byte(l.entry.LogID.String()))
+		}
+		if !p.sendToDLQ(ctx, dlqMsg, l.err) {
+			return false
+		}
+	}
+
+	msgs := make([]kafka.Message, len(batch.logs))
+	for i, l := range batch.logs {
+		msgs[i] = l.msg
+	}
+	if err := reader.CommitMessages(ctx, msgs...); err != nil {
+		slog.Error("Failed to commit offsets", "messages", len(msgs), "error", err)
+	}
+	recordOutcomes(batch)
+	slog.Info("Wrote batch", "messages", len(batch.logs), "stored", written)
+	return true
+}
+
+// recordOutcomes counts what happened to each message of a written batch.
+func recordOutcomes(batch *pendingBatch) {
+	for _, l := range batch.logs {
+		switch {
+		case l.err != nil:
+			messagesProcessed.WithLabelValues("dead_lettered").Inc()
+		case l.dropped:
+			messagesProcessed.WithLabelValues("dropped").Inc()
+		case l.duplicate:
+			messagesProcessed.WithLabelValues("duplicate").Inc()
+		default:
+			messagesProcessed.WithLabelValues("stored").Inc()
+			logsStored.WithLabelValues(projectLabels.Label(l.entry.ProjectID)).Inc()
+			messageLogger(l).Debug("Stored log")
+		}
+	}
+}
+
+// markDuplicates flags logs whose ID already occurred earlier in the batch,
+// such as a redelivered message or a client retry with the same idempotency
+// key. Duplicates across batches are skipped by the ClickHouse insert and
+// overwrite themselves in Cassandra.
+func markDuplicates(batch *pendingBatch) {
+	seen := make(map[gocql.UUID]bool, len(batch.logs))
+	duplicates := 0
+	for _, l := range batch.logs {
+		if l.entry == nil {
+			continue
+		}
+		if seen[l.entry.LogID] {
+			l.duplicate = true
+			duplicates++
+			messageLogger(l).Debug("Skipping duplicate log")
+			continue
+		}
+		seen[l.entry.LogID] = true
+	}
+	if duplicates > 0 {
+		slog.Info("Skipping duplicate logs in batch", "duplicates", duplicates)
+	}
+}
+
+// resolveSettings loads the settings of every project in the batch and marks
+// logs of unknown projects as dropped.
+func (p *processor) resolveSettings(ctx context.Context, batch *pendingBatch) bool {
+	type lookup struct {
+		settings ProjectSettings
+		found    bool
+		err      error
+	}
+	lookups := make(map[string]lookup)
+	for _, l := range batch.logs {
+		if l.err != nil {
+			continue
+		}
+		projectID := l.entry.ProjectID
+		res, ok := lookups[projectID]
+		if !ok {
+			res.err = retryUntilDone(ctx, func() error {
+				var err error
+				res.settings, res.found, err = p.projectSettings.Get(projectID)
+				return err
+			})
+			if ctx.Err() != nil {
+				return false
+			}
+			if res.err == nil && !res.found {
+				slog.Warn("Dropping logs for unknown project", "project_id", projectID)
+			}
+			lookups[projectID] = res
+		}
+		switch {
+		case res.err != nil:
+			l.err = fmt.Errorf("load settings for project %s: %w", projectID, res.err)
+		case !res.found:
+			l.dropped = true
+		default:
+			l.settings = res.settings
+		}
+	}
+	return true
+}
+
+func decodeMessage(m kafka.Message) (*decodedLog, error) {
+	var kafkaMsg KafkaLogMessage
+	if err := json.Unmarshal(m.Value, &kafkaMsg); err != nil {
+		return nil, &poisonError{fmt.Errorf("unmarshal Kafka message: %w", err)}
+	}
+
+	var logPayload LogPayload
+	if err := json.Unmarshal(kafkaMsg.Payload, &logPayload); err != nil {
+		return nil, &poisonError{fmt.Errorf("unmarshal log payload: %w", err)}
+	}
+	// A timestamp ClickHouse's DateTime cannot hold would fail the whole batch
+	if logPayload.Timestamp.Before(minEventTimestamp) || logPayload.Timestamp.After(maxEventTimestamp) {
+		return nil, &poisonError{fmt.Errorf("timestamp %v out of range", logPayload.Timestamp)}
+	}
+
+	// The project ID is looked up in CockroachDB, which would fail on
+	// anything but a UUID on every retry.
+	if _, err := gocql.ParseUUID(kafkaMsg.ProjectID); err != nil {
+		return nil, &poisonError{fmt.Errorf("invalid project ID %q", kafkaMsg.ProjectID)}
+	}
+
+	return &decodedLog{ProjectID: kafkaMsg.ProjectID, LogID: messageLogID(m, kafkaMsg.LogID, logPayload.Timestamp), Payload: logPayload}, nil
+}
+
+// retryUntilDone calls fn until it succeeds, returns a poisonError or ctx is
+// done, doubling the wait between attempts up to maxBackoff. Transient
+// errors are never given up on, so an outage stalls the batch instead of
+// moving live logs to the dead-letter topic.
+func retryUntilDone(ctx context.Context, fn func() error) error {
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var poison *poisonError
+		if errors.As(err, &poison) {
+			break
+		}
+		slog.Warn("Write attempt failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// projectSettingsTTL bounds how long a project's settings are cached
+	// before they are read again from CockroachDB.
+	projectSettingsTTL = time.Minute
+	// maxCassandraTTL is the largest TTL Cassandra accepts (20 years).
+	maxCassandraTTL = 630720000
+)
+
+// ProjectSettings holds the per-project configuration the processor needs
+// when writing logs.
+type ProjectSettings struct {
+	LogTTLSeconds int
+}
+
+// CassandraTTL returns the TTL to use in "USING TTL", where 0 means the row
+// never expires.
+func (s ProjectSettings) CassandraTTL() int {
+	if s.LogTTLSeconds <= 0 {
+		return 0
+	}
+	if s.LogTTLSeconds > maxCassandraTTL {
+		return maxCassandraTTL
+	}
+	return s.LogTTLSeconds
+}
+
+type cachedProjectSettings struct {
+	settings  ProjectSettings
+	found     bool
+	fetchedAt time.Time
+}
+
+// projectSettingsCache is a read-through cache of project settings backed by
+// the projects table in CockroachDB.
+type projectSettingsCache struct {
+	db      *sql.DB
+	mu      sync.RWMutex
+	entries map[string]cachedProjectSettings
+}
+
+func newProjectSettingsCache(db *sql.DB) *projectSettingsCache {
+	return &projectSettingsCache{db: db, entries: make(map[string]cachedProjectSettings)}
+}
+
+// Get returns the settings of a project. found is false when the project does
+// not exist or is being deleted, so that its logs are dropped. On a lookup
+// error a stale entry is returned if one is cached.
+func (c *projectSettingsCache) Get(projectID string) (settings ProjectSettings, found bool, err error) {
+	c.mu.RLock()
+	entry, ok := c.entries[projectID]
+	c.mu.RUnlock()
+	if ok && time.Since(entry.fetchedAt) < projectSettingsTTL {
+		return entry.settings, entry.found, nil
+	}
+
+	var s ProjectSettings
+	err = c.db.QueryRow("SELECT log_ttl_seconds FROM projects WHERE id = $1 AND is_active IS NOT FALSE", projectID).Scan(&s.LogTTLSeconds)
+	switch {
+	case err == sql.ErrNoRows:
+		found = false
+	case err != nil:
+		if ok {
+			return entry.settings, entry.found, nil
+		}
+		return ProjectSettings{}, false, err
+	default:
+		found = true
+	}
+
+	c.mu.Lock()
+	c.entries[projectID] = cachedProjectSettings{settings: s, found: found, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return s, found, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gocql/gocql"
+)
+
+// reconcileReport counts what reconciliation found in a time range.
+type reconcileReport struct {
+	InCassandra           int
+	InClickHouse          int
+	MissingFromClickHouse int
+	MissingFromCassandra  int
+	// OrphansKept are logs only in ClickHouse left alone because they are
+	// too recent or about to expire.
+	OrphansKept       int
+	Repaired          int
+	LookupRowsWritten int
+}
+
+func (r *reconcileReport) add(o reconcileReport) {
+	r.InCassandra += o.InCassandra
+	r.InClickHouse += o.InClickHouse
+	r.MissingFromClickHouse += o.MissingFromClickHouse
+	r.MissingFromCassandra += o.MissingFromCassandra
+	r.OrphansKept += o.OrphansKept
+	r.Repaired += o.Repaired
+	r.LookupRowsWritten += o.LookupRowsWritten
+}
+
+// cassandraLog is a row of the Cassandra logs table with what is needed to
+// rebuild its ClickHouse row.
+type cassandraLog struct {
+	LogID          gocql.UUID
+	Timestamp      time.Time
+	Name           string
+	SearchableKeys map[string]string
+	// TTL is the row's remaining TTL in seconds, 0 if it never expires.
+	TTL int
+	// WriteTime is when the row was written, in microseconds since the epoch.
+	WriteTime int64
+}
+
+// clickhouseRow is what reconciliation needs of a ClickHouse log row.
+type clickhouseRow struct {
+	ReceivedAt time.Time
+	TTLSeconds uint32
+}
+
+// reconciler compares the logs of one project in Cassandra and ClickHouse.
+type reconciler struct {
+	session   *gocql.Session
+	chConn    clickhouse.Conn
+	projectID string
+	settings  ProjectSettings
+	repair    bool
+	// deleteOrphans deletes logs only in ClickHouse once they are older than
+	// orphanGrace and not within orphanGrace of expiring.
+	deleteOrphans bool
+	orphanGrace   time.Duration
+	// backfillLookup rewrites the logs_by_id row of every log in the range,
+	// for logs stored before that table existed.
+	backfillLookup bool
+}
+
+// runReconcile implements "processor reconcile". It scans a time range of a
+// project's logs window by window and compares the log IDs in both stores.
+// With -repair, logs missing from ClickHouse are rebuilt from Cassandra. With
+// -delete-orphans, logs only in ClickHouse, whose payload is lost, are deleted
+// from it so that search no longer returns them; recent logs, whose Cassandra
+// write may not be visible yet, and logs about to expire are left alone. With
+// -backfill-lookup, every log's logs_by_id
+// row is written, so logs stored before that table existed can be read by ID
+// without a fallback scan.
+func runReconcile(session *gocql.Session, chConn clickhouse.Conn, projectSettings *projectSettingsCache, args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	projectID := fs.String("project", "", "ID of the project to reconcile (required)")
+	fromFlag := fs.String("from", "", "start of the time range, RFC 3339 (default: 24h before -to)")
+	toFlag := fs.String("to", "", "end of the time range, RFC 3339 (default: now)")
+	window := fs.Duration("window", time.Hour, "length of the slices the range is scanned in")
+	repair := fs.Bool("repair", false, "repair the gaps instead of only reporting them")
+	backfillLookup := fs.Bool("backfill-lookup", false, "write the logs_by_id row of every log in the range")
+	deleteOrphans := fs.Bool("delete-orphans", false, "delete logs that are in ClickHouse but not in Cassandra")
+	orphanGrace := fs.Duration("orphan-grace", time.Hour, "how old a log only in ClickHouse must be, and how far from expiring, before -delete-orphans deletes it")
+	fs.Parse(args)
+
+	if *projectID == "" {
+		fatal("reconcile: -project is required")
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		t, err := time.Parse(time.RFC3339, *toFlag)
+		if err != nil {
+			fatal("reconcile: invalid -to", "error", err)
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if *fromFlag != "" {
+		t, err := time.Parse(time.RFC3339, *fromFlag)
+		if err != nil {
+			fatal("reconcile: invalid -from", "error", err)
+		}
+		from = t
+	}
+	// ClickHouse stores whole seconds, so windows must start on one.
+	from, to = from.Truncate(time.Second), to.Truncate(time.Second)
+	if !from.Before(to) || *window < time.Second {
+		fatal("reconcile: -from must be before -to and -window at least 1s")
+	}
+	if *orphanGrace < 0 {
+		fatal("reconcile: -orphan-grace must not be negative")
+	}
+
+	settings, found, err := projectSettings.Get(*projectID)
+	if err != nil {
+		fatal("reconcile: failed to load project settings", "error", err)
+	}
+	if !found {
+		fatal("reconcile: project not found", "project_id", *projectID)
+	}
+
+	r := &reconciler{session: session, chConn: chConn, projectID: *projectID, settings: settings, repair: *repair,
+		deleteOrphans: *deleteOrphans, orphanGrace: *orphanGrace, backfillLookup: *backfillLookup}
+	ctx := context.Background()
+	var total reconcileReport
+	for start := from; start.Before(to); {
+		end := minTime(start.Add(window.Truncate(time.Second)), to)
+		report, err := r.reconcileWindow(ctx, start, end)
+		if err != nil {
+			fatal("reconcile: window failed", "from", start, "to", end, "error", err)
+		}
+		if report.MissingFromClickHouse > 0 || report.MissingFromCassandra > 0 {
+			slog.Info("Found differences", "from", start, "to", end,
+				"missing_from_clickhouse", report.MissingFromClickHouse,
+				"missing_from_cassandra", report.MissingFromCassandra, "orphans_kept", report.OrphansKept,
+				"repaired", report.Repaired)
+		}
+		total.add(report)
+		start = end
+	}
+	slog.Info("Reconciled project", "project_id", *projectID, "from", from, "to", to,
+		"in_cassandra", total.InCassandra, "in_clickhouse", total.InClickHouse,
+		"missing_from_clickhouse", total.MissingFromClickHouse,
+		"missing_from_cassandra", total.MissingFromCassandra, "orphans_kept", total.OrphansKept,
+		"repaired", total.Repaired,
+		"lookup_rows_written", total.LookupRowsWritten)
+}
+
+// reconcileWindow compares the log IDs stored for [from, to) and fixes the
+// differences r is set to repair.
+func (r *reconciler) reconcileWindow(ctx context.Context, from, to time.Time) (reconcileReport, error) {
+	var report reconcileReport
+
+	cassandraLogs, err := r.cassandraLogs(ctx, from, to)
+	if err != nil {
+		return report, err
+	}
+	clickhouseRows, err := r.clickhouseRows(ctx, from, to)
+	if err != nil {
+		return report, err
+	}
+	report.InCassandra = len(cassandraLogs)
+	report.InClickHouse = len(clickhouseRows)
+
+	var missingFromClickHouse []cassandraLog
+	for id, c := range cassandraLogs {
+		if _, ok := clickhouseRows[id]; !ok {
+			missingFromClickHouse = append(missingFromClickHouse, c)
+		}
+	}
+	now := time.Now()
+	var orphans []string
+	for id, row := range clickhouseRows {
+		if _, ok := cassandraLogs[id]; ok {
+			continue
+		}
+		report.MissingFromCassandra++
+		if orphanDeletable(row, now, r.orphanGrace) {
+			orphans = append(orphans, id)
+		} else {
+			report.OrphansKept++
+		}
+	}
+	report.MissingFromClickHouse = len(missingFromClickHouse)
+	if r.backfillLookup {
+		logs := make([]cassandraLog, 0, len(cassandraLogs))
+		for _, c := range cassandraLogs {
+			logs = append(logs, c)
+		}
+		if err := r.writeLookupRows(ctx, logs); err != nil {
+			return report, err
+		}
+		report.LookupRowsWritten = len(logs)
+	}
+	if r.repair && len(missingFromClickHouse) > 0 {
+		if err := r.restoreToClickHouse(ctx, missingFromClickHouse); err != nil {
+			return report, err
+		}
+		report.Repaired += len(missingFromClickHouse)
+	}
+	if r.deleteOrphans && len(orphans) > 0 {
+		if err := r.deleteFromClickHouse(ctx, orphans); err != nil {
+			return report, err
+		}
+		report.Repaired += len(orphans)
+	}
+	return report, nil
+}
+
+// orphanDeletable reports whether a log found only in ClickHouse may be
+// deleted. A log received less than grace ago may still be on its way into
+// Cassandra, or its row may not have been visible to the scan that ran just
+// before; a log within grace of expiring may only be missing because
+// Cassandra expired it first, and ClickHouse's TTL will drop it anyway.
+func orphanDeletable(row clickhouseRow, now time.Time, grace time.Duration) bool {
+	if now.Sub(row.ReceivedAt) < grace {
+		return false
+	}
+	if row.TTLSeconds == 0 {
+		return true
+	}
+	expiresAt := row.ReceivedAt.Add(time.Duration(row.TTLSeconds) * time.Second)
+	return expiresAt.Sub(now) > grace
+}
+
+func (r *reconciler) cassandraLogs(ctx context.Context, from, to time.Time) (map[string]cassandraLog, error) {
+	logs := make(map[string]cassandraLog)
+	scanner := r.session.Query(`
+		SELECT log_id, event_timestamp, event_name, searchable_keys, TTL(payload), WRITETIME(payload)
+		FROM logs WHERE project_id = ? AND event_timestamp >= ? AND event_timestamp < ?`,
+		r.projectID, from, to).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var c cassandraLog
+		if err := scanner.Scan(&c.LogID, &c.Timestamp, &c.Name, &c.SearchableKeys, &c.TTL, &c.WriteTime); err != nil {
+			return nil, fmt.Errorf("scan Cassandra log: %w", err)
+		}
+		logs[c.LogID.String()] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("query Cassandra logs: %w", err)
+	}
+	return logs, nil
+}
+
+func (r *reconciler) clickhouseRows(ctx context.Context, from, to time.Time) (map[string]clickhouseRow, error) {
+	rows, err := r.chConn.Query(ctx, `
+		SELECT toString(log_id), received_at, ttl_seconds FROM logs
+		WHERE project_id = ? AND event_timestamp >= toDateTime(?) AND event_timestamp < toDateTime(?)`,
+		r.projectID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query ClickHouse logs: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]clickhouseRow)
+	for rows.Next() {
+		var id string
+		var row clickhouseRow
+		if err := rows.Scan(&id, &row.ReceivedAt, &row.TTLSeconds); err != nil {
+			return nil, fmt.Errorf("scan ClickHouse log: %w", err)
+		}
+		ids[id] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query ClickHouse logs: %w", err)
+	}
+	return ids, nil
+}
+
+// restoreToClickHouse inserts ClickHouse rows rebuilt from Cassandra. Each row
+// keeps the time it was first received, so it expires with its Cassandra row.
+// The logs' lookup rows are rewritten as well, since they are written in the
+// same step the ClickHouse insert follows.
+func (r *reconciler) restoreToClickHouse(ctx context.Context, logs []cassandraLog) error {
+	batch, err := r.chConn.PrepareBatch(ctx,
+		`INSERT INTO logs (project_id, event_name, event_timestamp, log_id, searchable_keys, received_at, ttl_seconds)`)
+	if err != nil {
+		return fmt.Errorf("prepare ClickHouse batch: %w", err)
+	}
+	for _, c := range logs {
+		searchableKeys := c.SearchableKeys
+		if searchableKeys == nil {
+			searchableKeys = map[string]string{}
+		}
+		err := batch.Append(r.projectID, c.Name, c.Timestamp, c.LogID.String(), searchableKeys,
+			time.UnixMicro(c.WriteTime), uint32(r.settings.CassandraTTL()))
+		if err != nil {
+			batch.Abort()
+			return fmt.Errorf("append to ClickHouse batch: %w", err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("send ClickHouse batch: %w", err)
+	}
+	return r.writeLookupRows(ctx, logs)
+}
+
+// writeLookupRows writes the logs' logs_by_id rows with the remaining TTL of
+// their payload, so they expire together.
+func (r *reconciler) writeLookupRows(ctx context.Context, logs []cassandraLog) error {
+	for _, c := range logs {
+		err := r.session.Query(
+			`INSERT INTO logs_by_id (project_id, log_id, event_timestamp) VALUES (?, ?, ?) USING TTL ?`,
+			r.projectID, c.LogID, c.Timestamp, c.TTL,
+		).WithContext(ctx).Exec()
+		if err != nil {
+			return fmt.Errorf("insert log into Cassandra lookup table: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteFromClickHouse removes logs whose payload is not in Cassandra.
+func (r *reconciler) deleteFromClickHouse(ctx context.Context, ids []string) error {
+	for start := 0; start < len(ids); start += existingIDsChunkSize {
+		chunk := ids[start:min(start+existingIDsChunkSize, len(ids))]
+		err := deleteClickHouseLogs(ctx, r.chConn, "project_id = ? AND log_id IN (?)", r.projectID, chunk)
+		if err != nil {
+			return fmt.Errorf("delete logs from ClickHouse: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphanDeletable(t *testing.T) {
+	now := time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)
+	const grace = time.Hour
+	day := uint32((24 * time.Hour).Seconds())
+	tests := []struct {
+		name string
+		row  clickhouseRow
+		want bool
+	}{
+		{"received within grace", clickhouseRow{ReceivedAt: now.Add(-30 * time.Minute)}, false},
+		{"received just at grace", clickhouseRow{ReceivedAt: now.Add(-grace)}, true},
+		{"old without TTL", clickhouseRow{ReceivedAt: now.Add(-48 * time.Hour)}, true},
+		{"old with TTL far from expiry", clickhouseRow{ReceivedAt: now.Add(-2 * time.Hour), TTLSeconds: day}, true},
+		{"expiring within grace", clickhouseRow{ReceivedAt: now.Add(-23*time.Hour - 30*time.Minute), TTLSeconds: day}, false},
+		{"already expired", clickhouseRow{ReceivedAt: now.Add(-25 * time.Hour), TTLSeconds: day}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orphanDeletable(tt.row, now, grace); got != tt.want {
+				t.Errorf("orphanDeletable(%+v) = %v, want %v", tt.row, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@
 # A script to send a large volume of sample logs to the log ingestion API.
 #
 # Usage: ./scripts/load_test.sh <PROJECT_ID> <API_KEY>
+#
+# Set CONTENT_ENCODING=gzip or CONTENT_ENCODING=zstd to send compressed bodies.
 
 set -e
 
@@ -47,10 +49,18 @@ for (( i=1; i<=TOTAL_LOGS; i++ )); do
       }
     }'
 
-    curl -s -X POST "http://localhost:8083/api/projects/${PROJECT_ID}/logs" \
-    -H "Content-Type: application/json" \
-    -H "X-API-KEY: ${API_KEY}" \
-    -d "$JSON_PAYLOAD" &
+    if [ -n "$CONTENT_ENCODING" ]; then
+        printf '%s' "$JSON_PAYLOAD" | "$CONTENT_ENCODING" -c | curl -s -X POST "http://localhost:8083/api/projects/${PROJECT_ID}/logs" \
+        -H "Content-Type: application/json" \
+        -H "Content-Encoding: ${CONTENT_ENCODING}" \
+        -H "X-API-KEY: ${API_KEY}" \
+        --data-binary @- &
+    else
+        curl -s -X POST "http://localhost:8083/api/projects/${PROJECT_ID}/logs" \
+        -H "Content-Type: application/json" \
+        -H "X-API-KEY: ${API_KEY}" \
+        -d "$JSON_PAYLOAD" &
+    fi
 
     # manage concurrency, wait for all background jobs to finish every 100 requests.
     if (( i % 100 == 0 )); then